@@ -0,0 +1,346 @@
+/*
+JSON API
+
+Versioned under /api/v1. Errors are returned as {"error": {"code", "message"}}
+with a matching HTTP status.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const API_PREFIX = "/api/v1/"
+
+type ApiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiErrorResponse struct {
+	Error *ApiError `json:"error"`
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, status int, code string, message string) {
+	writeJson(w, status, &apiErrorResponse{&ApiError{code, message}})
+}
+
+// Map errors from the people store onto API errors
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNoSuchPerson, errNoSuchDevice:
+		writeJsonError(w, http.StatusNotFound, "not_found", err.Error())
+	case errNameRequired, errNoDeviceAddress, errBadMac:
+		writeJsonError(w, http.StatusBadRequest, "invalid", err.Error())
+	default:
+		log.Println(err)
+		metrics.CountDbError(DB_COMPONENT_API)
+		writeJsonError(w, http.StatusInternalServerError, "internal", "Internal error")
+	}
+}
+
+type ApiDevice struct {
+	Id                int64      `json:"id"`
+	Label             string     `json:"label"`
+	Mac               string     `json:"mac,omitempty"`
+	Hostname          string     `json:"hostname,omitempty"`
+	ClientId          string     `json:"client_id,omitempty"`
+	CountsForPresence bool       `json:"counts_for_presence"`
+	LastSeen          *time.Time `json:"last_seen,omitempty"`
+	Source            string     `json:"source,omitempty"`
+}
+
+type ApiPerson struct {
+	Id          int64        `json:"id"`
+	Name        string       `json:"name"`
+	Home        bool         `json:"home"`
+	Near        bool         `json:"near"`
+	LastSeen    *time.Time   `json:"last_seen,omitempty"`
+	AwayTimeout int64        `json:"away_timeout"`
+	Debounce    int64        `json:"debounce"`
+	Devices     []*ApiDevice `json:"devices"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func apiDevice(d *Device) *ApiDevice {
+	return &ApiDevice{
+		Id:                d.Id,
+		Label:             d.Label,
+		Mac:               d.Mac,
+		Hostname:          d.Hostname,
+		ClientId:          d.ClientId,
+		CountsForPresence: d.CountsForPresence,
+		LastSeen:          optionalTime(d.Last_seen),
+		Source:            d.Source,
+	}
+}
+
+func apiPerson(h *Housemate, now time.Time) *ApiPerson {
+	p := &ApiPerson{
+		Id:          h.Id,
+		Name:        h.Name,
+		Home:        h.isHome(),
+		Near:        h.isNear(now),
+		LastSeen:    optionalTime(h.Last_seen),
+		AwayTimeout: int64(h.AwayTimeout.Seconds()),
+		Debounce:    int64(h.Debounce.Seconds()),
+		Devices:     make([]*ApiDevice, 0, len(h.Devices)),
+	}
+	for _, d := range h.Devices {
+		p.Devices = append(p.Devices, apiDevice(d))
+	}
+	return p
+}
+
+// Request bodies. Timeouts are in seconds, with null meaning the default.
+type apiPersonRequest struct {
+	Name        string `json:"name"`
+	AwayTimeout *int64 `json:"away_timeout"`
+	Debounce    *int64 `json:"debounce"`
+}
+
+type apiDeviceRequest struct {
+	Label             string `json:"label"`
+	Mac               string `json:"mac"`
+	Hostname          string `json:"hostname"`
+	ClientId          string `json:"client_id"`
+	CountsForPresence *bool  `json:"counts_for_presence"`
+}
+
+func nullSeconds(seconds *int64) sql.NullInt64 {
+	if seconds == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *seconds, Valid: true}
+}
+
+func (req *apiPersonRequest) fields() *PersonFields {
+	return &PersonFields{req.Name, nullSeconds(req.AwayTimeout), nullSeconds(req.Debounce)}
+}
+
+func (req *apiDeviceRequest) fields() *DeviceFields {
+	d := &DeviceFields{req.Label, req.Mac, req.Hostname, req.ClientId, true}
+	if req.CountsForPresence != nil {
+		d.CountsForPresence = *req.CountsForPresence
+	}
+	return d
+}
+
+// Decode a JSON request body, writing an error response if it's no good
+func readJson(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(value); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "bad_json", err.Error())
+		return false
+	}
+	return true
+}
+
+func (t *WebServer) ApiV1(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, API_PREFIX), "/"), "/")
+
+	// Most resources are identified by a number
+	var id int64
+	numeric := false
+	if len(parts) > 1 {
+		var err error
+		id, err = strconv.ParseInt(parts[1], 10, 64)
+		numeric = err == nil
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "people":
+		t.apiPeople(w, r)
+	case len(parts) == 2 && numeric && parts[0] == "people":
+		t.apiPerson(w, r, id)
+	case len(parts) == 3 && numeric && parts[0] == "people" && parts[2] == "devices":
+		t.apiPersonDevices(w, r, id)
+	case len(parts) == 3 && numeric && parts[0] == "people" && parts[2] == "analytics":
+		t.apiPersonAnalytics(w, r, id)
+	case len(parts) == 1 && parts[0] == "analytics":
+		t.apiAnalytics(w, r)
+	case len(parts) == 1 && parts[0] == "status":
+		t.apiStatus(w, r)
+	case len(parts) == 1 && parts[0] == "presence":
+		t.apiPresence(w, r)
+	case len(parts) == 2 && parts[0] == "presence" && parts[1] == "events":
+		t.apiPresenceEvents(w, r)
+	case len(parts) == 1 && parts[0] == "override":
+		t.apiOverride(w, r)
+	case len(parts) == 1 && parts[0] == "settings":
+		t.apiSettings(w, r)
+	case len(parts) == 2 && parts[0] == "settings":
+		t.apiSetting(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "nodes":
+		t.apiNodes(w, r)
+	case len(parts) == 2 && numeric && parts[0] == "nodes":
+		t.apiNode(w, r, id)
+	case len(parts) == 3 && numeric && parts[0] == "nodes" && parts[2] == "readings":
+		t.apiNodeReadings(w, r, id)
+	case len(parts) == 2 && numeric && parts[0] == "devices":
+		t.apiDevice(w, r, id)
+	default:
+		writeJsonError(w, http.StatusNotFound, "not_found", "No such resource")
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJsonError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+}
+
+// GET lists everybody, POST adds somebody
+func (t *WebServer) apiPeople(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		now := time.Now()
+		people := make([]*ApiPerson, 0)
+		for _, h := range t.dhcp_tailer.Snapshot().People {
+			people = append(people, apiPerson(h, now))
+		}
+		writeJson(w, http.StatusOK, people)
+	case "POST":
+		req := new(apiPersonRequest)
+		if !readJson(w, r, req) {
+			return
+		}
+		id, err := t.dhcp_tailer.CreatePerson(req.fields())
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJson(w, http.StatusCreated, apiPerson(t.dhcp_tailer.Snapshot().Person(id), time.Now()))
+	default:
+		methodNotAllowed(w, "GET", "POST")
+	}
+}
+
+func (t *WebServer) apiPerson(w http.ResponseWriter, r *http.Request, id int64) {
+	var err error
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		req := new(apiPersonRequest)
+		if !readJson(w, r, req) {
+			return
+		}
+		err = t.dhcp_tailer.UpdatePerson(id, req.fields())
+	case "DELETE":
+		if err = t.dhcp_tailer.DeletePerson(id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		methodNotAllowed(w, "GET", "PUT", "DELETE")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	h := t.dhcp_tailer.Snapshot().Person(id)
+	if h == nil {
+		writeStoreError(w, errNoSuchPerson)
+		return
+	}
+	writeJson(w, http.StatusOK, apiPerson(h, time.Now()))
+}
+
+// POST adds a device to somebody
+func (t *WebServer) apiPersonDevices(w http.ResponseWriter, r *http.Request, person_id int64) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	req := new(apiDeviceRequest)
+	if !readJson(w, r, req) {
+		return
+	}
+	id, err := t.dhcp_tailer.CreateDevice(person_id, req.fields())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	t.writeDevice(w, http.StatusCreated, id)
+}
+
+func (t *WebServer) apiDevice(w http.ResponseWriter, r *http.Request, id int64) {
+	switch r.Method {
+	case "PUT":
+		req := new(apiDeviceRequest)
+		if !readJson(w, r, req) {
+			return
+		}
+		if err := t.dhcp_tailer.UpdateDevice(id, req.fields()); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		t.writeDevice(w, http.StatusOK, id)
+	case "DELETE":
+		if err := t.dhcp_tailer.DeleteDevice(id); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "PUT", "DELETE")
+	}
+}
+
+func (t *WebServer) writeDevice(w http.ResponseWriter, status int, id int64) {
+	d := t.dhcp_tailer.Snapshot().Device(id)
+	if d == nil {
+		writeStoreError(w, errNoSuchDevice)
+		return
+	}
+	writeJson(w, status, apiDevice(d))
+}
+
+// GET everybody's presence analytics, over ?days= days
+func (t *WebServer) apiAnalytics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	r.ParseForm()
+	writeJson(w, http.StatusOK, t.decider.getAllPresenceAnalytics(analyticsPeriod(r)))
+}
+
+func (t *WebServer) apiPersonAnalytics(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	r.ParseForm()
+	person := t.dhcp_tailer.Snapshot().Person(id)
+	if person == nil {
+		writeStoreError(w, errNoSuchPerson)
+		return
+	}
+	analytics, err := t.decider.getPresenceAnalytics(person, analyticsPeriod(r))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, analytics)
+}
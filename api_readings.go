@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Readings are returned for the last day unless asked otherwise
+const API_DEFAULT_READINGS_PERIOD = 24 * time.Hour
+
+type ApiMetric struct {
+	// The reading itself, or the mean over the bucket for rollups
+	Value float64  `json:"value"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Count int64    `json:"count,omitempty"`
+}
+
+type ApiReading struct {
+	Time     time.Time  `json:"time"`
+	Temp     *ApiMetric `json:"temp"`
+	Pressure *ApiMetric `json:"pressure"`
+	Humidity *ApiMetric `json:"humidity"`
+}
+
+type ApiReadings struct {
+	Node       int64         `json:"node"`
+	From       time.Time     `json:"from"`
+	To         time.Time     `json:"to"`
+	Resolution string        `json:"resolution"`
+	Readings   []*ApiReading `json:"readings"`
+}
+
+type ApiNode struct {
+	Id          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Named       bool        `json:"named"`
+	Color       string      `json:"color,omitempty"`
+	Primary     bool        `json:"primary"`
+	LastReading *ApiReading `json:"last_reading,omitempty"`
+}
+
+func rawMetric(v sql.NullFloat64) *ApiMetric {
+	if !v.Valid {
+		return nil
+	}
+	return &ApiMetric{Value: v.Float64}
+}
+
+func rollupMetric(mean, min, max sql.NullFloat64, count sql.NullInt64) *ApiMetric {
+	if !mean.Valid {
+		return nil
+	}
+	m := &ApiMetric{Value: mean.Float64, Count: count.Int64}
+	if min.Valid {
+		m.Min = &min.Float64
+	}
+	if max.Valid {
+		m.Max = &max.Float64
+	}
+	return m
+}
+
+// Readings from a node between two times, at the given resolution
+func (d *Decider) getReadingsBetween(node_id int64, from, to time.Time, res *Resolution) ([]*ApiReading, error) {
+	columns := strings.Join(READING_METRICS, ", ")
+	if res != RESOLUTION_RAW {
+		aggregates := make([]string, 0)
+		for _, metric := range READING_METRICS {
+			for _, agg := range []string{"mean", "min", "max", "count"} {
+				aggregates = append(aggregates, metric+"_"+agg)
+			}
+		}
+		columns = strings.Join(aggregates, ", ")
+	}
+
+	rows, err := d.db.Query(fmt.Sprintf(`
+		SELECT timestamp, %s FROM %s
+		WHERE node_id = ? AND timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp ASC
+	`, columns, res.Table), node_id, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readings := make([]*ApiReading, 0)
+	for rows.Next() {
+		r := new(ApiReading)
+		if res == RESOLUTION_RAW {
+			var temp, pressure, humidity sql.NullFloat64
+			if err := rows.Scan(&r.Time, &temp, &pressure, &humidity); err != nil {
+				return nil, err
+			}
+			r.Temp = rawMetric(temp)
+			r.Pressure = rawMetric(pressure)
+			r.Humidity = rawMetric(humidity)
+		} else {
+			var values [3][3]sql.NullFloat64
+			var counts [3]sql.NullInt64
+			dest := []interface{}{&r.Time}
+			for i := range READING_METRICS {
+				dest = append(dest, &values[i][0], &values[i][1], &values[i][2], &counts[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return nil, err
+			}
+			r.Temp = rollupMetric(values[0][0], values[0][1], values[0][2], counts[0])
+			r.Pressure = rollupMetric(values[1][0], values[1][1], values[1][2], counts[1])
+			r.Humidity = rollupMetric(values[2][0], values[2][1], values[2][2], counts[2])
+		}
+		readings = append(readings, r)
+	}
+	return readings, rows.Err()
+}
+
+// Every node that has a name, or has reported recently enough to have been
+// rolled up
+func (d *Decider) getNodes() ([]*ApiNode, error) {
+	rows, err := d.db.Query(`
+		SELECT node_id FROM node_names
+		UNION SELECT DISTINCT node_id FROM readings_daily
+		UNION SELECT DISTINCT node_id FROM readings
+			WHERE timestamp > DATE_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 DAY)
+		ORDER BY node_id`)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*ApiNode, 0, len(ids))
+	for _, id := range ids {
+		node, err := d.getNode(id)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func (d *Decider) getNode(node_id int64) (*ApiNode, error) {
+	node := &ApiNode{Id: node_id}
+
+	var r, g, b uint8
+	err := d.db.QueryRow("SELECT name, graph_r, graph_g, graph_b FROM node_names WHERE node_id = ?",
+		node_id).Scan(&node.Name, &r, &g, &b)
+	switch err {
+	case nil:
+		node.Named = true
+		node.Color = fmt.Sprintf("#%02x%02x%02x", r, g, b)
+	case sql.ErrNoRows:
+		node.Name = fmt.Sprintf("Node %d", node_id)
+	default:
+		return nil, err
+	}
+
+	if primary, err := d.settings.GetInt(SETTING_PRIMARY_NODE); err == nil {
+		node.Primary = primary == node_id
+	}
+
+	last := new(ApiReading)
+	var temp, pressure, humidity sql.NullFloat64
+	err = d.db.QueryRow(`SELECT timestamp, temp, pressure, humidity FROM readings
+		WHERE node_id = ? ORDER BY timestamp DESC LIMIT 1`, node_id).Scan(
+		&last.Time, &temp, &pressure, &humidity)
+	switch err {
+	case nil:
+		last.Temp = rawMetric(temp)
+		last.Pressure = rawMetric(pressure)
+		last.Humidity = rawMetric(humidity)
+		node.LastReading = last
+	case sql.ErrNoRows:
+	default:
+		return nil, err
+	}
+	return node, nil
+}
+
+// Parse a time given as RFC 3339 or Unix seconds
+func parseApiTime(value string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func resolutionByName(name string) *Resolution {
+	for _, res := range RESOLUTIONS {
+		if res.Name == name {
+			return res
+		}
+	}
+	return nil
+}
+
+// GET lists every node
+func (t *WebServer) apiNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	nodes, err := t.decider.getNodes()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, nodes)
+}
+
+func (t *WebServer) apiNode(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	node, err := t.decider.getNode(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !node.Named && node.LastReading == nil {
+		writeJsonError(w, http.StatusNotFound, "not_found", "No such node")
+		return
+	}
+	writeJson(w, http.StatusOK, node)
+}
+
+// GET a node's readings, limited by ?from= and ?to=, at ?resolution= (raw,
+// minute, hourly, daily, or auto to pick one to suit the range)
+func (t *WebServer) apiNodeReadings(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	r.ParseForm()
+
+	to := time.Now()
+	if value := r.Form.Get("to"); value != "" {
+		parsed, err := parseApiTime(value)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid", "to must be RFC 3339 or Unix seconds")
+			return
+		}
+		to = parsed
+	}
+	from := to.Add(-API_DEFAULT_READINGS_PERIOD)
+	if value := r.Form.Get("from"); value != "" {
+		parsed, err := parseApiTime(value)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid", "from must be RFC 3339 or Unix seconds")
+			return
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		writeJsonError(w, http.StatusBadRequest, "invalid", "from must be before to")
+		return
+	}
+
+	var res *Resolution
+	switch name := r.Form.Get("resolution"); name {
+	case "", "auto":
+		res = chooseResolution(t.config, to.Sub(from), time.Since(from))
+	default:
+		res = resolutionByName(name)
+		if res == nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid",
+				"resolution must be one of auto, raw, minute, hourly or daily")
+			return
+		}
+		if res.MaxSpan != 0 && to.Sub(from) > res.MaxSpan {
+			writeJsonError(w, http.StatusBadRequest, "range_too_large",
+				fmt.Sprintf("%s readings can only be fetched %s at a time", res.Name, res.MaxSpan))
+			return
+		}
+		if !t.config.Retains(res, time.Since(from)) {
+			writeJsonError(w, http.StatusBadRequest, "range_too_old",
+				fmt.Sprintf("%s readings are only kept for %s", res.Name, t.config.RetentionFor(res)))
+			return
+		}
+	}
+
+	readings, err := t.decider.getReadingsBetween(id, from, to, res)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, &ApiReadings{
+		Node:       id,
+		From:       from,
+		To:         to,
+		Resolution: res.Name,
+		Readings:   readings,
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Temperatures are always in °C
+type ApiStatus struct {
+	Now            time.Time       `json:"now"`
+	FurnaceOn      bool            `json:"furnace_on"`
+	CurrentTemp    *float64        `json:"current_temp"`
+	ActiveTemp     float64         `json:"active_temp"`
+	IdleTemp       float64         `json:"idle_temp"`
+	Override       *ApiOverride    `json:"override"`
+	Presence       *ApiPresence    `json:"presence"`
+	RecentReadings []*ApiNode      `json:"recent_readings"`
+	Uptime         int64           `json:"uptime"`
+	Degraded       bool            `json:"degraded"`
+	Ingest         *ApiIngest      `json:"ingest"`
+	Database       *SettingsHealth `json:"database"`
+}
+
+type ApiIngest struct {
+	Queued     int    `json:"queued"`
+	Spooled    int    `json:"spooled"`
+	LagSeconds int64  `json:"lag_seconds"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+type ApiOverride struct {
+	Active bool       `json:"active"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+type ApiPresence struct {
+	Occupied    bool         `json:"occupied"`
+	AnybodyHome bool         `json:"anybody_home"`
+	AnybodyNear bool         `json:"anybody_near"`
+	GuestMode   bool         `json:"guest_mode"`
+	GuestsHome  bool         `json:"guests_home"`
+	People      []*ApiPerson `json:"people"`
+}
+
+type ApiPresenceEvent struct {
+	Time     time.Time `json:"time"`
+	PersonId int64     `json:"person_id"`
+	Name     string    `json:"name"`
+	Event    string    `json:"event"`
+	Device   string    `json:"device,omitempty"`
+}
+
+type ApiSetting struct {
+	Key         string      `json:"key"`
+	Type        SettingType `json:"type"`
+	Unit        string      `json:"unit,omitempty"`
+	Min         float64     `json:"min"`
+	Max         *float64    `json:"max,omitempty"`
+	Default     string      `json:"default,omitempty"`
+	Description string      `json:"description"`
+	Internal    bool        `json:"internal"`
+	// Null if the setting has no value and no default
+	Value *string `json:"value"`
+}
+
+func (d *Decider) getApiOverride() *ApiOverride {
+	o := new(ApiOverride)
+	o.Active = d.getOverride()
+	if o.Active {
+		started, err := d.settings.GetInt(SETTING_OVERRIDE)
+		if err == nil {
+			until := time.Unix(started, 0).Add(OVERRIDE_DURATION)
+			o.Until = &until
+		}
+	}
+	return o
+}
+
+func (d *Decider) getApiPresence() *ApiPresence {
+	p := new(ApiPresence)
+	now := time.Now()
+	snapshot := d.dhcp_tailer.Snapshot()
+	p.Occupied = d.anybodyHome()
+	p.AnybodyHome = snapshot.AnybodyHome()
+	p.AnybodyNear = snapshot.AnybodyNear(now)
+	p.GuestMode = d.getGuestMode()
+	p.GuestsHome = d.dhcp_tailer.GuestsHome()
+	p.People = make([]*ApiPerson, 0, len(snapshot.People))
+	for _, h := range snapshot.People {
+		p.People = append(p.People, apiPerson(h, now))
+	}
+	return p
+}
+
+func apiSetting(def *SettingDef, value string, err error) *ApiSetting {
+	s := &ApiSetting{
+		Key:         def.Key,
+		Type:        def.Type,
+		Unit:        def.Unit,
+		Min:         def.Min,
+		Default:     def.Default,
+		Description: def.Description,
+		Internal:    def.Internal,
+	}
+	if def.Max > def.Min {
+		max := def.Max
+		s.Max = &max
+	}
+	if err == nil {
+		s.Value = &value
+	}
+	return s
+}
+
+// GET everything on the status page
+func (t *WebServer) apiStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	status := new(ApiStatus)
+	status.Now = time.Now()
+	status.FurnaceOn = t.decider.getLastFurnaceState()
+	if temp, _, err := t.decider.getLastPrimaryReading(); err == nil {
+		status.CurrentTemp = &temp
+	}
+	status.ActiveTemp = t.decider.getActiveTemp()
+	status.IdleTemp = t.decider.getIdleTemp()
+	status.Override = t.decider.getApiOverride()
+	status.Presence = t.decider.getApiPresence()
+	status.RecentReadings = make([]*ApiNode, 0)
+	for _, reading := range t.decider.getRecentReadings() {
+		status.RecentReadings = append(status.RecentReadings, &ApiNode{
+			Id:   reading.Node,
+			Name: reading.Name,
+			LastReading: &ApiReading{
+				Time:     reading.Time,
+				Temp:     rawMetric(reading.Temp),
+				Pressure: rawMetric(reading.Pressure),
+				Humidity: rawMetric(reading.Humidity),
+			},
+		})
+	}
+	status.Uptime = int64(time.Now().Sub(t.server_started).Seconds())
+	ingest := t.decider.ingest.Stats()
+	status.Ingest = &ApiIngest{
+		Queued:     ingest.Queued,
+		Spooled:    ingest.Spooled,
+		LagSeconds: int64(ingest.Lag.Seconds()),
+		LastError:  ingest.LastError,
+	}
+	status.Database = t.decider.settings.Health()
+	status.Degraded = status.Database.Degraded || ingest.LastError != ""
+	writeJson(w, http.StatusOK, status)
+}
+
+// GET everybody's presence
+func (t *WebServer) apiPresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	writeJson(w, http.StatusOK, t.decider.getApiPresence())
+}
+
+// GET recent arrivals and departures, newest first, up to ?limit=
+func (t *WebServer) apiPresenceEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	r.ParseForm()
+	limit, err := strconv.Atoi(r.Form.Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	rows, err := t.decider.db.Query(`SELECT e.timestamp, e.person, p.name, e.event, e.device
+		FROM nest.presence_events e LEFT JOIN nest.people p ON p.id = e.person
+		ORDER BY e.timestamp DESC, e.id DESC LIMIT ?`, limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	events := make([]*ApiPresenceEvent, 0)
+	for rows.Next() {
+		e := new(ApiPresenceEvent)
+		var name, device sql.NullString
+		if err := rows.Scan(&e.Time, &e.PersonId, &name, &e.Event, &device); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		e.Name = name.String
+		e.Device = device.String
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, events)
+}
+
+// GET whether the override is on, POST to turn it on, DELETE to turn it off
+func (t *WebServer) apiOverride(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case "GET":
+	case "POST":
+		err = t.decider.settings.SetInt(SETTING_OVERRIDE, time.Now().Unix(), webActor(r))
+	case "DELETE":
+		err = t.decider.settings.SetInt(SETTING_OVERRIDE, 0, webActor(r))
+	default:
+		methodNotAllowed(w, "GET", "POST", "DELETE")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, t.decider.getApiOverride())
+}
+
+// GET every setting along with its current value
+func (t *WebServer) apiSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	settings := make([]*ApiSetting, 0, len(SETTINGS_REGISTRY))
+	for _, def := range SETTINGS_REGISTRY {
+		value, err := t.decider.settings.Get(def.Key)
+		settings = append(settings, apiSetting(def, value, err))
+	}
+	writeJson(w, http.StatusOK, settings)
+}
+
+// GET or PUT a single setting. PUT takes {"value": ...}, where the value may be
+// a string, number or boolean.
+func (t *WebServer) apiSetting(w http.ResponseWriter, r *http.Request, key string) {
+	def, err := lookupSetting(key)
+	if err != nil {
+		writeJsonError(w, http.StatusNotFound, "not_found", err.Error())
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		if def.Internal {
+			writeJsonError(w, http.StatusForbidden, "read_only", key+" can't be changed directly")
+			return
+		}
+		req := new(struct {
+			Value json.RawMessage `json:"value"`
+		})
+		if !readJson(w, r, req) {
+			return
+		}
+		var value string
+		if err := json.Unmarshal(req.Value, &value); err != nil {
+			// Numbers and booleans are validated from their JSON text
+			value = string(req.Value)
+		}
+		if _, err := def.Validate(value); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		if err := t.decider.settings.Set(key, value, webActor(r)); err == ErrSetpointsCrossed {
+			writeJsonError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		} else if err != nil {
+			writeJsonError(w, http.StatusServiceUnavailable, "unavailable", err.Error())
+			return
+		}
+	default:
+		methodNotAllowed(w, "GET", "PUT")
+		return
+	}
+
+	value, err := t.decider.settings.Get(key)
+	writeJson(w, http.StatusOK, apiSetting(def, value, err))
+}
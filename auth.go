@@ -0,0 +1,358 @@
+/*
+Users, sessions and API tokens
+
+People log in to the web UI with a username and password, and get a session
+cookie. Scripts use per-user API tokens instead. Users either only read, or
+can also control the heating and change settings.
+
+Passwords are stored as salted PBKDF2-SHA256 hashes. Session and API tokens
+are random, and only their SHA-256 hashes are stored.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PASSWORD_HASH_SCHEME = "pbkdf2-sha256"
+const PASSWORD_HASH_ITERATIONS = 100000
+const PASSWORD_MIN_LENGTH = 8
+
+const SESSION_LIFETIME = 30 * 24 * time.Hour
+
+var errBadLogin = errors.New("Wrong username or password")
+var errPasswordTooShort = fmt.Errorf("Passwords must be at least %d characters", PASSWORD_MIN_LENGTH)
+var errNoSuchToken = errors.New("No such API token")
+
+type Permission int
+
+const (
+	PERMISSION_NONE Permission = iota
+	PERMISSION_READ
+	PERMISSION_CONTROL
+)
+
+type User struct {
+	Id         int64
+	Username   string
+	CanControl bool
+}
+
+func (u *User) Permission() Permission {
+	if u == nil {
+		return PERMISSION_NONE
+	}
+	if u.CanControl {
+		return PERMISSION_CONTROL
+	}
+	return PERMISSION_READ
+}
+
+type Session struct {
+	User    *User
+	Csrf    string
+	Expires time.Time
+	// Raw token for the cookie; only set when the session is created
+	token string
+}
+
+type ApiToken struct {
+	Id       int64
+	Name     string
+	Created  time.Time
+	LastUsed sql.NullTime
+}
+
+type AuthStore struct {
+	db *sql.DB
+}
+
+func NewAuthStore(c *Config) *AuthStore {
+	t := new(AuthStore)
+
+	db, err := sql.Open("mysql", c.GetSqlURI())
+	if err != nil {
+		log.Println(err)
+	}
+	t.db = db
+
+	return t
+}
+
+func pbkdf2Sha256(password, salt []byte, iterations, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < length; block++ {
+		u := hmacSum(prf, salt, block)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			u = hmacSum(prf, u, 0)
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:length]
+}
+
+// HMAC of the data, followed by the block number if it's non-zero
+func hmacSum(prf hash.Hash, data []byte, block uint32) []byte {
+	prf.Reset()
+	prf.Write(data)
+	if block != 0 {
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], block)
+		prf.Write(buf[:])
+	}
+	return prf.Sum(nil)
+}
+
+// Hash a password as "pbkdf2-sha256$iterations$salt$hash"
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2Sha256([]byte(password), salt, PASSWORD_HASH_ITERATIONS, sha256.Size)
+	return strings.Join([]string{
+		PASSWORD_HASH_SCHEME,
+		strconv.Itoa(PASSWORD_HASH_ITERATIONS),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+func checkPassword(password, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != PASSWORD_HASH_SCHEME {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key := pbkdf2Sha256([]byte(password), salt, iterations, len(expected))
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// A new random token, and the hash it's stored as
+func newToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *AuthStore) CreateUser(username, password string, can_control bool) error {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return errors.New("A username is needed")
+	}
+	if len(password) < PASSWORD_MIN_LENGTH {
+		return errPasswordTooShort
+	}
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = t.db.Exec(`INSERT INTO nest.users (username, password_hash, can_control)
+		VALUES (?, ?, ?)`, username, hashed, can_control)
+	return err
+}
+
+// Change a user's password, signing them out everywhere, so a reset after a
+// compromise locks the attacker out
+func (t *AuthStore) SetPassword(user_id int64, password string) error {
+	if len(password) < PASSWORD_MIN_LENGTH {
+		return errPasswordTooShort
+	}
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE nest.users SET password_hash = ? WHERE id = ?`, hashed, user_id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM nest.sessions WHERE user = ?`, user_id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (t *AuthStore) SetPasswordByName(username, password string) error {
+	var id int64
+	err := t.db.QueryRow(`SELECT id FROM nest.users WHERE username = ?`, username).Scan(&id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("No such user '%s'", username)
+	}
+	if err != nil {
+		return err
+	}
+	return t.SetPassword(id, password)
+}
+
+// Check a username and password, returning the user they belong to
+func (t *AuthStore) Authenticate(username, password string) (*User, error) {
+	u := new(User)
+	var hashed string
+	err := t.db.QueryRow(`SELECT id, username, can_control, password_hash
+		FROM nest.users WHERE username = ?`, username).Scan(
+		&u.Id, &u.Username, &u.CanControl, &hashed)
+	if err == sql.ErrNoRows {
+		// Take as long as a real check, so usernames can't be probed
+		checkPassword(password, PASSWORD_HASH_SCHEME+"$"+strconv.Itoa(PASSWORD_HASH_ITERATIONS)+"$AAAA$AAAA")
+		return nil, errBadLogin
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !checkPassword(password, hashed) {
+		return nil, errBadLogin
+	}
+	return u, nil
+}
+
+func (t *AuthStore) CreateSession(user *User) (*Session, error) {
+	token, token_hash, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	csrf, _, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// Tidy up while we're here
+	if _, err := t.db.Exec(`DELETE FROM nest.sessions WHERE expires < ?`, time.Now().UTC()); err != nil {
+		log.Println(err)
+	}
+
+	s := &Session{User: user, Csrf: csrf, Expires: time.Now().Add(SESSION_LIFETIME), token: token}
+	_, err = t.db.Exec(`INSERT INTO nest.sessions (token_hash, user, csrf_token, expires)
+		VALUES (?, ?, ?, ?)`, token_hash, user.Id, csrf, s.Expires.UTC())
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// The session a cookie belongs to, or nil if it's unknown or expired
+func (t *AuthStore) LookupSession(token string) (*Session, error) {
+	s := &Session{User: new(User)}
+	err := t.db.QueryRow(`SELECT u.id, u.username, u.can_control, s.csrf_token, s.expires
+		FROM nest.sessions s INNER JOIN nest.users u ON u.id = s.user
+		WHERE s.token_hash = ? AND s.expires > ?`, hashToken(token), time.Now().UTC()).Scan(
+		&s.User.Id, &s.User.Username, &s.User.CanControl, &s.Csrf, &s.Expires)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (t *AuthStore) DeleteSession(token string) error {
+	_, err := t.db.Exec(`DELETE FROM nest.sessions WHERE token_hash = ?`, hashToken(token))
+	return err
+}
+
+// Create an API token for a user, returning it. It can't be read back later.
+func (t *AuthStore) CreateApiToken(user *User, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("Give the token a name, so you know what it's for")
+	}
+	token, token_hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = t.db.Exec(`INSERT INTO nest.api_tokens (user, name, token_hash)
+		VALUES (?, ?, ?)`, user.Id, name, token_hash)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (t *AuthStore) ApiTokens(user *User) ([]*ApiToken, error) {
+	rows, err := t.db.Query(`SELECT id, name, created, last_used FROM nest.api_tokens
+		WHERE user = ? ORDER BY created`, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]*ApiToken, 0)
+	for rows.Next() {
+		token := new(ApiToken)
+		if err := rows.Scan(&token.Id, &token.Name, &token.Created, &token.LastUsed); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (t *AuthStore) RevokeApiToken(user *User, id int64) error {
+	res, err := t.db.Exec(`DELETE FROM nest.api_tokens WHERE id = ? AND user = ?`, id, user.Id)
+	return checkAffected(res, err, errNoSuchToken)
+}
+
+// The user an API token belongs to, or nil if it's unknown
+func (t *AuthStore) LookupApiToken(token string) (*User, error) {
+	u := new(User)
+	var token_id int64
+	err := t.db.QueryRow(`SELECT t.id, u.id, u.username, u.can_control
+		FROM nest.api_tokens t INNER JOIN nest.users u ON u.id = t.user
+		WHERE t.token_hash = ?`, hashToken(token)).Scan(
+		&token_id, &u.Id, &u.Username, &u.CanControl)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.db.Exec(`UPDATE nest.api_tokens SET last_used = ? WHERE id = ?`,
+		time.Now().UTC(), token_id)
+	if err != nil {
+		log.Println(err)
+	}
+	return u, nil
+}
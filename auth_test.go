@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors from RFC 7914, section 11
+func TestPbkdf2Sha256(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		length     int
+		want       string
+	}{
+		{"passwd", "salt", 1, 64,
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+				"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64,
+			"4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+				"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, test := range tests {
+		got := hex.EncodeToString(pbkdf2Sha256([]byte(test.password), []byte(test.salt), test.iterations, test.length))
+		if got != test.want {
+			t.Errorf("pbkdf2Sha256(%q, %q, %d, %d) = %s, want %s",
+				test.password, test.salt, test.iterations, test.length, got, test.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	encoded, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword("hunter2", encoded) {
+		t.Errorf("checkPassword rejected the right password")
+	}
+	if checkPassword("hunter3", encoded) {
+		t.Errorf("checkPassword accepted the wrong password")
+	}
+	if checkPassword("hunter2", "sha256$1$c2FsdA$") {
+		t.Errorf("checkPassword accepted an unknown scheme")
+	}
+}
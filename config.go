@@ -4,6 +4,7 @@ import (
 	"code.google.com/p/gcfg"
 	"log"
 	"strings"
+	"time"
 )
 
 var build_version string
@@ -23,16 +24,69 @@ type Config struct {
 		BindPort    string
 	}
 
+	Presence struct {
+		Source            []string
+		SyslogPath        string
+		SyslogProgram     []string
+		ListenAddress     string
+		ListenPort        string
+		ListenAllow       []string
+		DhcpdLeasesPath   string
+		DnsmasqLeasesPath string
+		ArpPath           string
+		PollSeconds       int
+		EventWebhook      []string
+		OwnTracksRegion   string
+		HomeLatitude      float64
+		HomeLongitude     float64
+		NearMeters        int
+	}
+
+	Display struct {
+		Timezone string
+	}
+
 	Templates struct {
-		Status string
+		Status    string
+		Settings  string
+		Guests    string
+		People    string
+		Analytics string
+		Login     string
+		Account   string
+	}
+
+	Auth struct {
+		SecureCookies bool
 	}
 
 	Mail struct {
 		Host   string
 		Target string
 	}
+
+	Ingest struct {
+		QueueSize int
+		BatchSize int
+		SpoolPath string
+	}
+
+	State struct {
+		SettingsCache string
+	}
+
+	Retention struct {
+		RawDays    int
+		MinuteDays int
+		HourlyDays int
+		DailyDays  int
+	}
+
+	display_location *time.Location
 }
 
+const DISPLAY_TIME_FORMAT = "2006-01-02 15:04:05 MST"
+
 func (kc Config) GetSqlURI() string {
 	mysql_auth_strings := []string{kc.Mysql.MysqlUser,
 		":",
@@ -45,7 +99,8 @@ func (kc Config) GetSqlURI() string {
 		kc.Mysql.MysqlServerPort,
 		")/",
 		kc.Mysql.MysqlDatabase,
-		"?parseTime=true",
+		// Keep everything in UTC on both sides of the connection
+		"?parseTime=true&loc=UTC&time_zone=%27%2B00%3A00%27",
 	}
 	return strings.Join(mysql_auth_strings, "")
 }
@@ -56,5 +111,22 @@ func LoadConfiguration(config_path string) *Config {
 	if err != nil {
 		log.Fatal("Failed to parse gcfg data: ", err)
 	}
+
+	kc.display_location = time.Local
+	if kc.Display.Timezone != "" {
+		kc.display_location, err = time.LoadLocation(kc.Display.Timezone)
+		if err != nil {
+			log.Fatal("Failed to load display timezone: ", err)
+		}
+	}
 	return kc
 }
+
+// Timezone that times should be shown to users in
+func (kc *Config) DisplayLocation() *time.Location {
+	return kc.display_location
+}
+
+func (kc *Config) FormatTime(t time.Time) string {
+	return t.In(kc.display_location).Format(DISPLAY_TIME_FORMAT)
+}
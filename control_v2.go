@@ -0,0 +1,341 @@
+/*
+Base station control protocol, version 2
+
+The base station posts JSON to /control/v2 with any number of nodes' readings,
+each with a sequence number and, optionally, extra metrics such as battery
+voltage. It gets back an explicit furnace command, the setpoint being aimed
+for, how long to wait before reporting again and a code for anything that was
+wrong with the request. The form protocol on /control keeps working for base
+stations that haven't been updated.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const CONTROL_V2_PATH = "/control/v2"
+const CONTROL_PROTOCOL_VERSION = 2
+
+// Keep a single request, and the batch it becomes, to a sensible size
+const CONTROL_MAX_BODY = 64 * 1024
+const CONTROL_MAX_READINGS = 64
+const CONTROL_MAX_METRICS = 16
+
+// Readings claiming to be older than this are refused, rather than being
+// written into history a long way back
+const CONTROL_MAX_READING_AGE = time.Hour
+
+// Sequence numbers this close behind a node's newest are remembered, so that
+// readings sent out of order are still taken. One further back is taken as
+// the node having restarted or wrapped around.
+const CONTROL_SEQUENCE_WINDOW = 2 * CONTROL_MAX_READINGS
+
+// Furnace commands
+const CONTROL_COMMAND_ON = "on"
+const CONTROL_COMMAND_OFF = "off"
+const CONTROL_COMMAND_HOLD = "hold"
+
+// Error codes
+const CONTROL_ERROR_BAD_JSON = "bad_json"
+const CONTROL_ERROR_VERSION = "unsupported_version"
+const CONTROL_ERROR_NO_READINGS = "no_readings"
+const CONTROL_ERROR_TOO_MANY = "too_many_readings"
+const CONTROL_ERROR_BAD_NODE = "bad_node"
+const CONTROL_ERROR_NO_DATA = "no_data"
+const CONTROL_ERROR_BAD_METRIC = "bad_metric"
+const CONTROL_ERROR_BAD_AGE = "bad_age"
+const CONTROL_ERROR_DUPLICATE = "duplicate"
+const CONTROL_ERROR_NO_PRIMARY = "no_primary_node"
+
+var controlMetricName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+type ControlReading struct {
+	NodeId   *int64             `json:"node_id"`
+	Sequence *int64             `json:"sequence"`
+	Age      float64            `json:"age"`
+	Temp     *float64           `json:"temp"`
+	Pressure *float64           `json:"pressure"`
+	Humidity *float64           `json:"humidity"`
+	Metrics  map[string]float64 `json:"metrics"`
+}
+
+type ControlRequest struct {
+	Version  int               `json:"version"`
+	Sequence int64             `json:"sequence"`
+	Uptime   float64           `json:"uptime"`
+	Readings []*ControlReading `json:"readings"`
+}
+
+type ControlError struct {
+	NodeId   *int64 `json:"node_id,omitempty"`
+	Sequence *int64 `json:"sequence,omitempty"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+type ControlResponse struct {
+	Version      int             `json:"version"`
+	Sequence     int64           `json:"sequence"`
+	Command      string          `json:"command"`
+	FurnaceOn    bool            `json:"furnace_on"`
+	Setpoint     float64         `json:"setpoint"`
+	Occupied     bool            `json:"occupied"`
+	Override     bool            `json:"override"`
+	PollInterval int64           `json:"poll_interval"`
+	Accepted     int             `json:"accepted"`
+	Errors       []*ControlError `json:"errors"`
+}
+
+// What we know about the base station from its last report
+type BaseStation struct {
+	mutex     sync.Mutex
+	uptime    float64
+	last_seen time.Time
+	sequences map[int64]*NodeSequences
+}
+
+// Sequence numbers recently seen from a node
+type NodeSequences struct {
+	newest int64
+	seen   map[int64]bool
+}
+
+func NewBaseStation() *BaseStation {
+	t := new(BaseStation)
+	t.sequences = make(map[int64]*NodeSequences)
+	return t
+}
+
+// Note the base station's uptime, forgetting sequence numbers if it has
+// restarted since it last reported
+func (t *BaseStation) Report(uptime float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if uptime < t.uptime {
+		log.Println("Base station restarted after", time.Duration(t.uptime)*time.Second)
+		t.sequences = make(map[int64]*NodeSequences)
+	}
+	t.uptime = uptime
+	t.last_seen = time.Now()
+}
+
+// Whether a node's reading has already been seen, recording it if not
+func (t *BaseStation) Repeated(node_id, sequence int64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s := t.sequences[node_id]
+	if s != nil && s.newest-sequence >= CONTROL_SEQUENCE_WINDOW {
+		log.Println("Node", node_id, "went back from reading", s.newest, "to", sequence,
+			"so it must have restarted")
+		s = nil
+	}
+	if s == nil {
+		s = &NodeSequences{newest: sequence, seen: make(map[int64]bool)}
+		t.sequences[node_id] = s
+	}
+	if s.seen[sequence] {
+		return true
+	}
+	s.seen[sequence] = true
+	if sequence > s.newest {
+		s.newest = sequence
+		for seen := range s.seen {
+			if s.newest-seen >= CONTROL_SEQUENCE_WINDOW {
+				delete(s.seen, seen)
+			}
+		}
+	}
+	return false
+}
+
+// The base station's uptime as of its last report, if it has ever reported
+func (t *BaseStation) Uptime() (float64, time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.uptime, t.last_seen
+}
+
+func controlError(reading *ControlReading, code string, format string, args ...interface{}) *ControlError {
+	e := &ControlError{Code: code, Message: fmt.Sprintf(format, args...)}
+	if reading != nil {
+		e.NodeId = reading.NodeId
+		e.Sequence = reading.Sequence
+	}
+	return e
+}
+
+func nullFloat(v *float64) sql.NullFloat64 {
+	if v == nil {
+		return sql.NullFloat64{}
+	}
+	return sql.NullFloat64{Float64: *v, Valid: true}
+}
+
+// Turn a reading from the request into one to be logged, or explain what's
+// wrong with it
+func (t *WebServer) controlReading(reading *ControlReading, now time.Time) (*QueuedReading, *ControlError) {
+	if reading.NodeId == nil || *reading.NodeId < 0 {
+		return nil, controlError(reading, CONTROL_ERROR_BAD_NODE, "Reading has no node_id")
+	}
+	if reading.Temp == nil && reading.Pressure == nil && reading.Humidity == nil && len(reading.Metrics) == 0 {
+		return nil, controlError(reading, CONTROL_ERROR_NO_DATA, "Reading from node %d has nothing in it", *reading.NodeId)
+	}
+	if reading.Age < 0 || reading.Age > CONTROL_MAX_READING_AGE.Seconds() {
+		return nil, controlError(reading, CONTROL_ERROR_BAD_AGE, "Reading age must be between 0 and %d seconds",
+			int64(CONTROL_MAX_READING_AGE.Seconds()))
+	}
+	if len(reading.Metrics) > CONTROL_MAX_METRICS {
+		return nil, controlError(reading, CONTROL_ERROR_BAD_METRIC, "At most %d extra metrics per reading",
+			CONTROL_MAX_METRICS)
+	}
+	for name := range reading.Metrics {
+		if !controlMetricName.MatchString(name) {
+			return nil, controlError(reading, CONTROL_ERROR_BAD_METRIC, "Bad metric name '%s'", name)
+		}
+	}
+	if reading.Sequence != nil && t.base_station.Repeated(*reading.NodeId, *reading.Sequence) {
+		return nil, controlError(reading, CONTROL_ERROR_DUPLICATE, "Already have reading %d from node %d",
+			*reading.Sequence, *reading.NodeId)
+	}
+
+	queued := &QueuedReading{
+		Time:     now.Add(-time.Duration(reading.Age * float64(time.Second))),
+		Node:     *reading.NodeId,
+		Temp:     nullFloat(reading.Temp),
+		Pressure: nullFloat(reading.Pressure),
+		Humidity: nullFloat(reading.Humidity),
+	}
+	if len(reading.Metrics) > 0 {
+		queued.Metrics = reading.Metrics
+	}
+	return queued, nil
+}
+
+func (t *WebServer) controlV2Error(w http.ResponseWriter, status int, req *ControlRequest, code, message string) {
+	metrics.CountControlResponse("v2-error")
+	response := &ControlResponse{
+		Version: CONTROL_PROTOCOL_VERSION,
+		Command: CONTROL_COMMAND_HOLD,
+		Errors:  []*ControlError{{Code: code, Message: message}},
+	}
+	if req != nil {
+		response.Sequence = req.Sequence
+	}
+	t.fillControlResponse(response)
+	writeJson(w, status, response)
+}
+
+// The current state the base station should know about
+func (t *WebServer) fillControlResponse(response *ControlResponse) {
+	response.FurnaceOn = t.decider.getLastFurnaceState()
+	response.Occupied = t.decider.anybodyHome()
+	response.Override = t.decider.getOverride()
+	if response.Occupied {
+		response.Setpoint = t.decider.getActiveTemp()
+	} else {
+		response.Setpoint = t.decider.getIdleTemp()
+	}
+	poll_interval, err := t.decider.settings.GetInt(SETTING_POLL_INTERVAL)
+	if err != nil {
+		log.Println(err)
+	}
+	response.PollInterval = poll_interval
+}
+
+func (t *WebServer) ControlV2Page(w http.ResponseWriter, r *http.Request) {
+	t.last_update = time.Now()
+	now := time.Now()
+
+	req := new(ControlRequest)
+	r.Body = http.MaxBytesReader(w, r.Body, CONTROL_MAX_BODY)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		t.controlV2Error(w, http.StatusBadRequest, nil, CONTROL_ERROR_BAD_JSON, err.Error())
+		return
+	}
+	if req.Version != CONTROL_PROTOCOL_VERSION {
+		t.controlV2Error(w, http.StatusBadRequest, req, CONTROL_ERROR_VERSION,
+			fmt.Sprintf("Only version %d is understood here", CONTROL_PROTOCOL_VERSION))
+		return
+	}
+	if len(req.Readings) > CONTROL_MAX_READINGS {
+		t.controlV2Error(w, http.StatusBadRequest, req, CONTROL_ERROR_TOO_MANY,
+			fmt.Sprintf("At most %d readings per request", CONTROL_MAX_READINGS))
+		return
+	}
+	t.base_station.Report(req.Uptime)
+
+	response := &ControlResponse{
+		Version:  CONTROL_PROTOCOL_VERSION,
+		Sequence: req.Sequence,
+		Command:  CONTROL_COMMAND_HOLD,
+		Errors:   make([]*ControlError, 0),
+	}
+	if len(req.Readings) == 0 {
+		response.Errors = append(response.Errors,
+			controlError(nil, CONTROL_ERROR_NO_READINGS, "Request has no readings"))
+	}
+
+	primary_node, primary_err := t.decider.settings.GetInt(SETTING_PRIMARY_NODE)
+	if primary_err != nil {
+		log.Println(primary_err)
+		response.Errors = append(response.Errors,
+			controlError(nil, CONTROL_ERROR_NO_PRIMARY, "No primary node is set, so the furnace is left alone"))
+	}
+
+	// Log everything that makes sense, and control the furnace from the
+	// newest temperature the primary node sent
+	var primary *QueuedReading
+	for _, reading := range req.Readings {
+		queued, cerr := t.controlReading(reading, now)
+		if cerr != nil {
+			log.Println("Bad reading from base station:", cerr.Message)
+			response.Errors = append(response.Errors, cerr)
+			continue
+		}
+		t.decider.logQueuedReading(queued)
+		response.Accepted++
+		if primary_err == nil && queued.Node == primary_node && queued.Temp.Valid &&
+			(primary == nil || queued.Time.After(primary.Time)) {
+			primary = queued
+		}
+	}
+
+	// Without a fresh temperature, pass on any decision made when somebody
+	// came or went since the last poll
+	commanded := false
+	furnace_on := false
+	if primary != nil {
+		furnace_on = t.decider.ShouldFurnace(primary.Temp.Float64)
+		t.decider.commandFurnace(furnace_on, CONTROL_ACTOR)
+		commanded = true
+	} else if primary_err == nil {
+		// Left queued while there's no primary node, for when there is one
+		if pending, ok := t.decider.takePendingFurnace(); ok {
+			furnace_on = pending
+			t.decider.commandFurnace(furnace_on, PRESENCE_ACTOR)
+			commanded = true
+		}
+	}
+	if commanded && furnace_on {
+		response.Command = CONTROL_COMMAND_ON
+	} else if commanded {
+		response.Command = CONTROL_COMMAND_OFF
+	}
+	t.fillControlResponse(response)
+	if commanded {
+		// Say what we decided even if it couldn't be saved
+		response.FurnaceOn = furnace_on
+	}
+
+	metrics.CountControlResponse("v2-" + response.Command)
+	writeJson(w, http.StatusOK, response)
+}
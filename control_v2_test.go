@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBaseStationRepeated(t *testing.T) {
+	tests := []struct {
+		name      string
+		sequences []int64
+		want      []bool
+	}{
+		{"in order", []int64{1, 2, 3}, []bool{false, false, false}},
+		{"resent", []int64{1, 2, 2, 1}, []bool{false, false, true, true}},
+		{"newest first", []int64{12, 11, 10, 12, 11}, []bool{false, false, false, true, true}},
+		{"gap filled later", []int64{10, 13, 11, 12, 13}, []bool{false, false, false, false, true}},
+		{"node restarted", []int64{500, 0, 1, 0}, []bool{false, false, false, true}},
+		{"just inside the window", []int64{200, 200 - CONTROL_SEQUENCE_WINDOW + 1, 200 - CONTROL_SEQUENCE_WINDOW + 1},
+			[]bool{false, false, true}},
+		{"forgotten once out of the window", []int64{1, 1 + CONTROL_SEQUENCE_WINDOW, 1}, []bool{false, false, false}},
+	}
+	for _, test := range tests {
+		b := NewBaseStation()
+		for i, sequence := range test.sequences {
+			if got := b.Repeated(7, sequence); got != test.want[i] {
+				t.Errorf("%s: reading %d (%d) repeated = %v, want %v", test.name, i, sequence, got, test.want[i])
+			}
+		}
+	}
+
+	// Nodes are tracked separately, and forgotten when the base station restarts
+	b := NewBaseStation()
+	b.Report(100)
+	b.Repeated(1, 5)
+	if b.Repeated(2, 5) {
+		t.Errorf("reading from another node counted as repeated")
+	}
+	b.Report(10)
+	if b.Repeated(1, 5) {
+		t.Errorf("reading counted as repeated after the base station restarted")
+	}
+}
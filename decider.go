@@ -6,21 +6,46 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"log"
 	"math/rand"
+	"sort"
+	"sync"
 	"time"
 )
 
-const SETTING_IDLE_TEMP = "idle_temp"
-const SETTING_ACTIVE_TEMP = "min_temp"
-const SETTING_OVERRIDE = "override"
-const SETTING_FURNACE_ON = "furnace_on"
-const SETTING_PRIMARY_NODE = "primary_node"
+// Default period of history shown on the status page and graphs
+const HISTORY_PERIOD = time.Hour * 24 * 7
+
+// How long the heat stays on after the override is turned on
+const OVERRIDE_DURATION = time.Minute * 20
+
+// How often node names are reloaded from the database
+const NODE_NAMES_REFRESH = time.Minute
 
 type Decider struct {
 	db          *sql.DB
+	config      *Config
+	settings    *SettingsStore
+	ingest      *ReadingIngest
 	dhcp_tailer *DhcpStatus
+
+	// Latest reading from each node since startup, by node ID
+	latest_mutex sync.Mutex
+	latest       map[int64]*QueuedReading
+
+	events *LiveEvents
+
+	// Node names by node ID, kept in memory so that scrapes and live events
+	// don't wait on the database. Left as they were if a reload fails.
+	names_mutex sync.Mutex
+	node_names  map[int64]string
+
+	// A furnace decision made when somebody came or went, waiting to be sent
+	// with the next reply to the base station
+	pending_mutex   sync.Mutex
+	pending_furnace bool
+	furnace_pending bool
 }
 
-func NewDecider(c *Config, d *DhcpStatus) *Decider {
+func NewDecider(c *Config, d *DhcpStatus, ingest *ReadingIngest) *Decider {
 	t := new(Decider)
 
 	db, err := sql.Open("mysql", c.GetSqlURI())
@@ -28,86 +53,59 @@ func NewDecider(c *Config, d *DhcpStatus) *Decider {
 		log.Println(err)
 	}
 	t.db = db
+	t.config = c
+	t.settings = NewSettingsStore(c, db)
 
 	t.dhcp_tailer = d
+	t.ingest = ingest
+	t.latest = make(map[int64]*QueuedReading)
+	t.events = NewLiveEvents()
+	t.settings.Watch(t.publishSetting)
 
-	return t
-}
-
-func (d *Decider) getFloatSetting(name string) (float64, error) {
-	row := d.db.QueryRow("SELECT `value` FROM `settings` WHERE `key` = ?", name)
-	var fv float64
-	err := row.Scan(&fv)
-	return fv, err
-}
-
-func (d *Decider) setFloatSetting(name string, value float64) error {
-	_, err := d.db.Exec(
-		"INSERT INTO settings (`key`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `value` = ?",
-		name, value, value,
-	)
-	return err
-}
-
-func (d *Decider) getBoolSetting(name string) (bool, error) {
-	row := d.db.QueryRow("SELECT `value` FROM `settings` WHERE `key` = ?", name)
-	var bv bool
-	err := row.Scan(&bv)
-	return bv, err
-}
-
-func (d *Decider) setBoolSetting(name string, value bool) error {
-	_, err := d.db.Exec(
-		"INSERT INTO settings (`key`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `value` = ?",
-		name, value, value,
-	)
-	return err
-}
-
-func (d *Decider) getIntSetting(name string) (int64, error) {
-	row := d.db.QueryRow("SELECT `value` FROM `settings` WHERE `key` = ?", name)
-	var bv int64
-	err := row.Scan(&bv)
-	return bv, err
-}
+	t.node_names = make(map[int64]string)
+	if err := t.loadNodeNames(); err != nil {
+		log.Println(err)
+	}
 
-func (d *Decider) setIntSetting(name string, value int64) error {
-	_, err := d.db.Exec(
-		"INSERT INTO settings (`key`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `value` = ?",
-		name, value, value,
-	)
-	return err
+	return t
 }
 
 func (d *Decider) getIdleTemp() float64 {
 	// Grab the temperature to keep the house at when unoccupied
-	temp, err := d.getFloatSetting(SETTING_IDLE_TEMP)
+	temp, err := d.settings.GetFloat(SETTING_IDLE_TEMP)
 	if err != nil {
 		log.Println(err)
-		return 12.50
 	}
 	return temp
 }
 
 func (d *Decider) getActiveTemp() float64 {
 	// Get the temperature to keep the house at when occupied
-	temp, err := d.getFloatSetting(SETTING_ACTIVE_TEMP)
+	temp, err := d.settings.GetFloat(SETTING_ACTIVE_TEMP)
 	if err != nil {
 		log.Println(err)
-		return 15.50
 	}
 	return temp
 }
 
+// How far past the target the furnace runs once on, as a fraction
+func (d *Decider) getHysteresis() float64 {
+	hysteresis, err := d.settings.GetFloat(SETTING_HYSTERESIS)
+	if err != nil {
+		log.Println(err)
+	}
+	return hysteresis / 100
+}
+
 func (d *Decider) getOverride() bool {
 	// Return whether the furnace override is on
-	override, err := d.getIntSetting(SETTING_OVERRIDE)
+	override, err := d.settings.GetInt(SETTING_OVERRIDE)
 	if err != nil {
 		log.Println(err)
 		return false
 	}
 	override_started := time.Unix(override, 0)
-	override_until := override_started.Add(time.Minute * 20)
+	override_until := override_started.Add(OVERRIDE_DURATION)
 	if override_until.Before(time.Now()) {
 		return false
 	} else {
@@ -116,33 +114,54 @@ func (d *Decider) getOverride() bool {
 }
 
 func (d *Decider) anybodyHome() bool {
-	last_seen := d.dhcp_tailer.LastPersonActive()
-	if last_seen == nil {
-		return false
+	// People on their way home count, so the house is warm when they arrive
+	if d.dhcp_tailer.AnybodyHome() || d.dhcp_tailer.AnybodyNear() {
+		return true
+	}
+	return d.getGuestMode() && d.dhcp_tailer.GuestsHome()
+}
+
+func (d *Decider) getGuestMode() bool {
+	guest_mode, err := d.settings.GetBool(SETTING_GUEST_MODE)
+	if err != nil {
+		log.Println(err)
 	}
-	return last_seen.isHome()
+	return guest_mode
 }
 
 func (d *Decider) getLastFurnaceState() bool {
 	// Return the state the furnace was in last time.
 	// True = on, false = off
-	state, err := d.getBoolSetting(SETTING_FURNACE_ON)
+	state, err := d.settings.GetBool(SETTING_FURNACE_ON)
 	if err != nil {
-		return false
+		log.Println(err)
 	}
 	return state
 }
 
 func (d *Decider) getLastTemperature() float64 {
+	temp, _, err := d.getLastPrimaryReading()
+	if err != nil {
+		log.Println(err)
+	}
+	return temp
+}
+
+// Latest temperature from the primary node, and when it was taken
+func (d *Decider) getLastPrimaryReading() (float64, time.Time, error) {
+	var temp float64
+	var timestamp time.Time
+	primary_node, err := d.settings.GetInt(SETTING_PRIMARY_NODE)
+	if err != nil {
+		return temp, timestamp, err
+	}
 	row := d.db.QueryRow(`
-		SELECT readings.temp FROM readings, settings
-		WHERE readings.node_id = settings.value
-		AND settings.key = "primary_node"
+		SELECT temp, timestamp FROM readings
+		WHERE node_id = ? AND temp IS NOT NULL
 		ORDER BY timestamp DESC LIMIT 1
-	`)
-	var temp float64
-	row.Scan(&temp)
-	return temp
+	`, primary_node)
+	err = row.Scan(&temp, &timestamp)
+	return temp, timestamp, err
 }
 
 type NodePlotOpts struct {
@@ -173,6 +192,52 @@ func (d *Decider) getNodePlotOpts(node_id int64) *NodePlotOpts {
 	return opts
 }
 
+func (d *Decider) loadNodeNames() error {
+	rows, err := d.db.Query("SELECT node_id, name FROM node_names")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	names := make(map[int64]string)
+	for rows.Next() {
+		var node_id int64
+		var name string
+		if err := rows.Scan(&node_id, &name); err != nil {
+			return err
+		}
+		names[node_id] = name
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	d.names_mutex.Lock()
+	d.node_names = names
+	d.names_mutex.Unlock()
+	return nil
+}
+
+// Keep the node names up to date with the database
+func (d *Decider) WatchNodeNames() {
+	for {
+		time.Sleep(NODE_NAMES_REFRESH)
+		if err := d.loadNodeNames(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// A node's name, as last loaded, without touching the database
+func (d *Decider) nodeName(node_id int64) string {
+	d.names_mutex.Lock()
+	defer d.names_mutex.Unlock()
+	if name, ok := d.node_names[node_id]; ok {
+		return name
+	}
+	return fmt.Sprintf("Node %d", node_id)
+}
+
 type ReadingHistory map[int64][]*ReadingData
 
 type ReadingData struct {
@@ -219,18 +284,20 @@ func (d *Decider) getRecentReadings() []*ReadingData {
 		reading.Name = node_info.Name
 		reading.Staleness = time.Now().Round(time.Second).Sub(
 			reading.Time.Round(time.Second),
-		) - (time.Hour * 5)
+		)
 		r = append(r, reading)
 	}
 	return r
 }
 
-func (d *Decider) getReadingHistory() ReadingHistory {
-	// Get all the node IDs that have reported data in the past week
-	node_id_rows, err := d.db.Query(`SELECT  node_id
-		FROM  readings
-		WHERE  timestamp > DATE_SUB( CURRENT_TIMESTAMP( ) , INTERVAL 1 WEEK )
-		GROUP BY  node_id `)
+func (d *Decider) getReadingHistory(period time.Duration) ReadingHistory {
+	res := chooseResolution(d.config, period, period)
+
+	// Get all the node IDs that have reported data in the period
+	node_id_rows, err := d.db.Query(fmt.Sprintf(`SELECT  node_id
+		FROM  %s
+		WHERE  timestamp > DATE_SUB( CURRENT_TIMESTAMP( ) , INTERVAL ? SECOND )
+		GROUP BY  node_id `, res.Table), int64(period.Seconds()))
 	if err != nil {
 		log.Println(err)
 		return nil
@@ -243,20 +310,27 @@ func (d *Decider) getReadingHistory() ReadingHistory {
 			log.Println(err)
 			continue
 		}
-		history[node_id] = d.getReadingHistoryForNode(node_id)
+		history[node_id] = d.getReadingHistoryForNode(node_id, period)
 	}
 
 	return history
 }
 
-func (d *Decider) getReadingHistoryForNode(node_id int64) []*ReadingData {
-	rows, err := d.db.Query(`
-		SELECT timestamp, temp, pressure, humidity FROM nest.readings WHERE
-		timestamp > DATE_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 WEEK)
-		AND id % 5 = 0
+func (d *Decider) getReadingHistoryForNode(node_id int64, period time.Duration) []*ReadingData {
+	res := chooseResolution(d.config, period, period)
+
+	// Raw readings hold the values directly, rollups hold their mean
+	columns := "temp, pressure, humidity"
+	if res != RESOLUTION_RAW {
+		columns = "temp_mean, pressure_mean, humidity_mean"
+	}
+
+	rows, err := d.db.Query(fmt.Sprintf(`
+		SELECT timestamp, %s FROM %s WHERE
+		timestamp > DATE_SUB(CURRENT_TIMESTAMP(), INTERVAL ? SECOND)
 		AND node_id = ?
 		ORDER BY timestamp ASC
-	`, node_id)
+	`, columns, res.Table), int64(period.Seconds()), node_id)
 	if err != nil {
 		log.Println(err)
 		return nil
@@ -309,27 +383,123 @@ func (d *Decider) getPeopleHistory() []*PeopleHistData {
 }
 
 func (d *Decider) LogReading(node_id int64, current_temp, current_pressure, current_humidity sql.NullFloat64) {
-	_, err := d.db.Exec(`INSERT INTO  nest.readings
-		(id, timestamp, node_id, temp, pressure, humidity)
-		VALUES
-		(NULL, CURRENT_TIMESTAMP, ?, ?, ?, ?)`,
-		node_id, current_temp, current_pressure, current_humidity)
-	if err != nil {
-		log.Println(err)
+	reading := &QueuedReading{
+		Time:     time.Now(),
+		Node:     node_id,
+		Temp:     current_temp,
+		Pressure: current_pressure,
+		Humidity: current_humidity,
 	}
+	d.logQueuedReading(reading)
+}
 
+// Log a reading that may have been taken a little while ago
+func (d *Decider) logQueuedReading(reading *QueuedReading) {
+	d.latest_mutex.Lock()
+	if latest, ok := d.latest[reading.Node]; !ok || !reading.Time.Before(latest.Time) {
+		d.latest[reading.Node] = reading
+	}
+	d.latest_mutex.Unlock()
+	d.ingest.Enqueue(reading)
+	d.publishReading(reading)
+}
+
+// The latest reading from every node heard from since startup, by node ID.
+// Unlike getRecentReadings, this doesn't touch the database.
+func (d *Decider) latestReadings() []*QueuedReading {
+	d.latest_mutex.Lock()
+	defer d.latest_mutex.Unlock()
+	readings := make([]*QueuedReading, 0, len(d.latest))
+	for _, reading := range d.latest {
+		readings = append(readings, reading)
+	}
+	sort.Slice(readings, func(i, j int) bool {
+		return readings[i].Node < readings[j].Node
+	})
+	return readings
 }
 
 func (d *Decider) LogPeople() {
-	for _, housemate := range d.dhcp_tailer.housemates {
-		_, err := d.db.Exec(`INSERT INTO  nest.people_history
-				(timestamp, person, is_home)
-				VALUES
-				(CURRENT_TIMESTAMP, ?, ?)`,
-			housemate.Id, housemate.isHome(),
-		)
+	// Everybody gets the same timestamp, which the graph groups by
+	now := time.Now()
+	for _, housemate := range d.dhcp_tailer.Snapshot().People {
+		if err := insertPeopleHistory(d.db, now, housemate.Id, housemate.isHome()); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func insertPeopleHistory(db *sql.DB, at time.Time, person int64, is_home bool) error {
+	_, err := db.Exec(`INSERT INTO nest.people_history
+		(timestamp, person, is_home)
+		VALUES (?, ?, ?)`,
+		at.UTC().Truncate(time.Second), person, is_home,
+	)
+	return err
+}
+
+// Actor recorded in the settings history for furnace changes made in response
+// to somebody arriving or leaving
+const PRESENCE_ACTOR = "presence"
+
+// Readings older than this aren't trusted to make a decision between polls
+const PRESENCE_DECISION_MAX_AGE = 10 * time.Minute
+
+// Queue a furnace command for the base station's next poll
+func (d *Decider) setPendingFurnace(furnace_on bool) {
+	d.pending_mutex.Lock()
+	defer d.pending_mutex.Unlock()
+	d.pending_furnace = furnace_on
+	d.furnace_pending = true
+}
+
+// Drop any queued command, once a newer decision has been made
+func (d *Decider) clearPendingFurnace() {
+	d.pending_mutex.Lock()
+	defer d.pending_mutex.Unlock()
+	d.furnace_pending = false
+}
+
+// Take the queued furnace command, if there is one
+func (d *Decider) takePendingFurnace() (bool, bool) {
+	d.pending_mutex.Lock()
+	defer d.pending_mutex.Unlock()
+	pending := d.furnace_pending
+	d.furnace_pending = false
+	return d.pending_furnace, pending
+}
+
+// Command the furnace as part of a reply to the base station. furnace_on is
+// only ever set here, so it is always the last command actually sent.
+func (d *Decider) commandFurnace(furnace_on bool, actor string) {
+	d.clearPendingFurnace()
+	if err := d.settings.SetBool(SETTING_FURNACE_ON, furnace_on, actor); err != nil {
+		log.Println(err)
+	}
+}
+
+// React to people arriving and leaving as it happens, rather than waiting for
+// the next reading from the primary node. The base station can only be told
+// what to do when it next polls, so the decision is queued until then.
+func (d *Decider) WatchPresence() {
+	for event := range d.dhcp_tailer.Subscribe() {
+		d.LogPeople()
+		d.publishPresence(event)
+
+		temp, taken, err := d.getLastPrimaryReading()
 		if err != nil {
 			log.Println(err)
+			continue
+		}
+		if time.Now().Sub(taken) > PRESENCE_DECISION_MAX_AGE {
+			continue
+		}
+		furnace_on := d.ShouldFurnace(temp)
+		if furnace_on != d.getLastFurnaceState() {
+			log.Println("Furnace", furnace_on, "at next poll after", event.Name, event.Type)
+			d.setPendingFurnace(furnace_on)
+		} else {
+			d.clearPendingFurnace()
 		}
 	}
 }
@@ -353,12 +523,13 @@ func (d *Decider) ShouldFurnace(current_temp float64) bool {
 	// Sticky furnace on - don't toggle too frequently
 	furnace_already_on := d.getLastFurnaceState()
 	if furnace_already_on {
+		hysteresis := 1 + d.getHysteresis()
 		if d.anybodyHome() {
-			if current_temp < d.getActiveTemp()*1.05 {
+			if current_temp < d.getActiveTemp()*hysteresis {
 				return true
 			}
 		} else {
-			if current_temp < d.getIdleTemp()*1.05 {
+			if current_temp < d.getIdleTemp()*hysteresis {
 				return true
 			}
 		}
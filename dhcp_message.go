@@ -0,0 +1,163 @@
+/*
+DHCP log messages
+
+Parses the DHCPDISCOVER, DHCPREQUEST and DHCPACK lines logged by ISC dhcpd and
+dnsmasq into structured messages, and normalises the hardware addresses and
+client identifiers found in them so that devices can be matched reliably.
+*/
+
+package main
+
+import (
+	"net"
+	"path"
+	"strings"
+)
+
+const DHCP_DISCOVER = "DHCPDISCOVER"
+const DHCP_REQUEST = "DHCPREQUEST"
+const DHCP_ACK = "DHCPACK"
+
+type DhcpMessage struct {
+	Type      string
+	Mac       string
+	Ip        string
+	Hostname  string
+	Interface string
+	ClientId  string
+}
+
+// Lower case, colon separated form of a MAC address written with colons,
+// dashes, Cisco style dots, or no separators at all. Returns "" for anything
+// that isn't a MAC.
+func normaliseMac(mac string) string {
+	hex := strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '-', '.':
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(mac)))
+	if len(hex) != 12 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return ""
+	}
+	parts := make([]string, 6)
+	for i := range parts {
+		parts[i] = hex[i*2 : i*2+2]
+	}
+	return strings.Join(parts, ":")
+}
+
+// Lower case, colon separated form of a DHCP client identifier
+func normaliseClientId(id string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(id)), "-", ":", -1)
+}
+
+// Hostnames are matched case insensitively, and devices can use glob patterns
+// such as "pixel-*" for phones that randomise their MAC.
+func hostnameMatches(pattern, hostname string) bool {
+	if pattern == "" || hostname == "" {
+		return false
+	}
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(hostname))
+	return matched
+}
+
+func isDhcpClientMessage(message_type string) bool {
+	switch message_type {
+	case DHCP_DISCOVER, DHCP_REQUEST, DHCP_ACK:
+		return true
+	}
+	return false
+}
+
+// Parse a DHCP server's log message. Returns nil for anything other than a
+// discover, request or acknowledgement naming a hardware address.
+func parseDhcpMessage(message string) *DhcpMessage {
+	fields := strings.Fields(message)
+	// dnsmasq prefixes messages with a transaction number when log-dhcp is on
+	if len(fields) > 0 && strings.Trim(fields[0], "0123456789") == "" {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return nil
+	}
+
+	var m *DhcpMessage
+	// dnsmasq writes the interface straight after the type, "DHCPACK(eth0)"
+	if open := strings.IndexByte(fields[0], '('); open > 0 && strings.HasSuffix(fields[0], ")") {
+		m = parseDnsmasqDhcpMessage(fields[1:])
+		if m != nil {
+			m.Interface = fields[0][open+1 : len(fields[0])-1]
+			m.Type = fields[0][:open]
+		}
+	} else {
+		m = parseDhcpdMessage(fields[1:])
+		if m != nil {
+			m.Type = fields[0]
+		}
+	}
+	if m == nil || !isDhcpClientMessage(m.Type) {
+		return nil
+	}
+	return m
+}
+
+// "[ip] mac [hostname]"
+func parseDnsmasqDhcpMessage(fields []string) *DhcpMessage {
+	m := new(DhcpMessage)
+	for i, field := range fields {
+		if mac := normaliseMac(field); mac != "" {
+			m.Mac = mac
+			if i > 0 && net.ParseIP(fields[i-1]) != nil {
+				m.Ip = fields[i-1]
+			}
+			// Anything longer is an explanation, such as "no address
+			// available", rather than a hostname
+			if len(fields) == i+2 {
+				m.Hostname = fields[i+1]
+			}
+			return m
+		}
+	}
+	return nil
+}
+
+// "for ip [(server)] from mac [(hostname)] via interface [uid id]", or with
+// "on ip ... to mac" for acknowledgements
+func parseDhcpdMessage(fields []string) *DhcpMessage {
+	m := new(DhcpMessage)
+	for i := 0; i < len(fields)-1; i++ {
+		next := strings.TrimSuffix(fields[i+1], ":")
+		switch fields[i] {
+		case "for", "on":
+			if net.ParseIP(next) != nil {
+				m.Ip = next
+			}
+		case "from", "to":
+			m.Mac = normaliseMac(next)
+			if m.Mac == "" {
+				continue
+			}
+			// The hostname is in brackets, and may contain spaces
+			if i+2 < len(fields) && strings.HasPrefix(fields[i+2], "(") {
+				end := i + 2
+				for end < len(fields)-1 && !strings.HasSuffix(fields[end], ")") {
+					end++
+				}
+				hostname := strings.Join(fields[i+2:end+1], " ")
+				m.Hostname = strings.TrimSuffix(strings.TrimPrefix(hostname, "("), ")")
+				i = end - 1
+			}
+		case "via":
+			// Either the interface, or the relay agent's address
+			m.Interface = next
+		case "uid":
+			m.ClientId = normaliseClientId(next)
+		}
+	}
+	if m.Mac == "" {
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormaliseMac(t *testing.T) {
+	tests := []struct {
+		mac  string
+		want string
+	}{
+		{"aa:bb:cc:dd:ee:ff", "aa:bb:cc:dd:ee:ff"},
+		{"AA:BB:CC:DD:EE:FF", "aa:bb:cc:dd:ee:ff"},
+		{"aa-bb-cc-dd-ee-ff", "aa:bb:cc:dd:ee:ff"},
+		{"aabb.ccdd.eeff", "aa:bb:cc:dd:ee:ff"},
+		{"aabbccddeeff", "aa:bb:cc:dd:ee:ff"},
+		{" aa:bb:cc:dd:ee:ff\n", "aa:bb:cc:dd:ee:ff"},
+		{"aa:bb:cc:dd:ee", ""},
+		{"aa:bb:cc:dd:ee:ff:00", ""},
+		{"gg:bb:cc:dd:ee:ff", ""},
+		{"10.0.0.5", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := normaliseMac(test.mac); got != test.want {
+			t.Errorf("normaliseMac(%q) = %q, want %q", test.mac, got, test.want)
+		}
+	}
+}
+
+func TestNormaliseClientId(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"01:aa:bb:cc:dd:ee:ff", "01:aa:bb:cc:dd:ee:ff"},
+		{"01-AA-BB-CC-DD-EE-FF", "01:aa:bb:cc:dd:ee:ff"},
+		{" ff:00 ", "ff:00"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := normaliseClientId(test.id); got != test.want {
+			t.Errorf("normaliseClientId(%q) = %q, want %q", test.id, got, test.want)
+		}
+	}
+}
+
+func TestHostnameMatches(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		hostname string
+		want     bool
+	}{
+		{"phone", "phone", true},
+		{"phone", "PHONE", true},
+		{"pixel-*", "Pixel-7", true},
+		{"pixel-*", "pixel", false},
+		{"phone", "phone2", false},
+		{"", "phone", false},
+		{"*", "", false},
+		{"[", "[", false},
+	}
+	for _, test := range tests {
+		if got := hostnameMatches(test.pattern, test.hostname); got != test.want {
+			t.Errorf("hostnameMatches(%q, %q) = %v, want %v", test.pattern, test.hostname, got, test.want)
+		}
+	}
+}
+
+func TestParseDhcpMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    *DhcpMessage
+	}{
+		{
+			"dhcpd request",
+			"DHCPREQUEST for 10.0.0.5 (10.0.0.1) from aa:bb:cc:dd:ee:ff (Pixel 7) via eth1",
+			&DhcpMessage{DHCP_REQUEST, "aa:bb:cc:dd:ee:ff", "10.0.0.5", "Pixel 7", "eth1", ""},
+		},
+		{
+			"dhcpd ack",
+			"DHCPACK on 10.0.0.5 to aa:bb:cc:dd:ee:ff (phone) via eth1",
+			&DhcpMessage{DHCP_ACK, "aa:bb:cc:dd:ee:ff", "10.0.0.5", "phone", "eth1", ""},
+		},
+		{
+			"dhcpd discover with no free leases",
+			"DHCPDISCOVER from AA-BB-CC-DD-EE-FF via eth1: network 10.0.0.0/24: no free leases",
+			&DhcpMessage{DHCP_DISCOVER, "aa:bb:cc:dd:ee:ff", "", "", "eth1", ""},
+		},
+		{
+			"dhcpd with client identifier",
+			"DHCPREQUEST for 10.0.0.5 from aa:bb:cc:dd:ee:ff via 10.0.1.1 uid 01-AA-BB-CC-DD-EE-FF",
+			&DhcpMessage{DHCP_REQUEST, "aa:bb:cc:dd:ee:ff", "10.0.0.5", "", "10.0.1.1", "01:aa:bb:cc:dd:ee:ff"},
+		},
+		{
+			"dhcpd unterminated hostname",
+			"DHCPREQUEST for 10.0.0.5 from aa:bb:cc:dd:ee:ff (phone",
+			&DhcpMessage{DHCP_REQUEST, "aa:bb:cc:dd:ee:ff", "10.0.0.5", "phone", "", ""},
+		},
+		{
+			"dnsmasq ack",
+			"DHCPACK(br0) 10.0.0.5 aa:bb:cc:dd:ee:ff phone",
+			&DhcpMessage{DHCP_ACK, "aa:bb:cc:dd:ee:ff", "10.0.0.5", "phone", "br0", ""},
+		},
+		{
+			"dnsmasq with transaction number",
+			"1234567 DHCPREQUEST(br0) 10.0.0.5 aa:bb:cc:dd:ee:ff",
+			&DhcpMessage{DHCP_REQUEST, "aa:bb:cc:dd:ee:ff", "10.0.0.5", "", "br0", ""},
+		},
+		{
+			"dnsmasq discover with an explanation",
+			"DHCPDISCOVER(br0) aa:bb:cc:dd:ee:ff no address available",
+			&DhcpMessage{DHCP_DISCOVER, "aa:bb:cc:dd:ee:ff", "", "", "br0", ""},
+		},
+		{"dhcpd release", "DHCPRELEASE of 10.0.0.5 from aa:bb:cc:dd:ee:ff via eth1 (found)", nil},
+		{"dhcpd inform", "DHCPINFORM from 10.0.0.5 via eth1", nil},
+		{"dnsmasq nak", "DHCPNAK(br0) 10.0.0.5 aa:bb:cc:dd:ee:ff wrong network", nil},
+		{"no mac", "DHCPACK on 10.0.0.5 to nobody via eth1", nil},
+		{"dnsmasq no mac", "DHCPACK(br0) 10.0.0.5 phone", nil},
+		{"type only", "DHCPACK", nil},
+		{"empty", "", nil},
+		{"other message", "Wrote 12 leases to leases file.", nil},
+	}
+
+	for _, test := range tests {
+		got := parseDhcpMessage(test.message)
+		if test.want == nil {
+			if got != nil {
+				t.Errorf("%s: got %+v, want nil", test.name, got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: got nil, want %+v", test.name, test.want)
+			continue
+		}
+		if *got != *test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
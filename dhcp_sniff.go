@@ -1,40 +1,131 @@
 /*
 DHCP Monitoring module
 
-Tails syslog, watching for DHCP requests from MAC addresses known to be mobiles,
-thus identifying if people are present on the network.
+Watches the configured presence sources, such as DHCP requests in syslog, for
+MAC addresses known to be mobiles, thus identifying if people are present on
+the network.
 */
 
 package main
 
 import (
+	"bufio"
 	"database/sql"
 	"github.com/ActiveState/tail"
 	_ "github.com/go-sql-driver/mysql"
+	"io"
 	"log"
-	"strings"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+type Device struct {
+	Id    int64
+	Label string
+	Mac   string
+	// Either a hostname, or a glob pattern matching several
+	Hostname          string
+	ClientId          string
+	CountsForPresence bool
+	Last_seen         time.Time
+	// Presence source that last saw this device
+	Source string
+	// Last sighting that has been saved to the database
+	persisted time.Time
+}
+
+// Whether an observation is of this device, by MAC, DHCP client identifier,
+// or hostname pattern. Both sides must already be normalised.
+func (d *Device) matches(observation *PresenceObservation) bool {
+	if d.Mac != "" && d.Mac == observation.Mac {
+		return true
+	}
+	if d.ClientId != "" && d.ClientId == observation.ClientId {
+		return true
+	}
+	return hostnameMatches(d.Hostname, observation.Hostname)
+}
+
 type Housemate struct {
-	Id           int64
-	Mac          string
-	Name         string
-	Last_seen    time.Time
-	SeenDuration time.Duration
-	IsHome       string
+	Id      int64
+	Name    string
+	Devices []*Device
+	// Last time any device that counts toward presence was seen, and which
+	// device that was
+	Last_seen  time.Time
+	LastDevice *Device
+	// Presence state, and the settings that govern moving between states
+	Home         bool
+	StateChanged time.Time
+	AwayTimeout  time.Duration
+	Debounce     time.Duration
+	// Whether the timeouts were set for this person, rather than defaulted
+	custom_away_timeout bool
+	custom_debounce     bool
+	// State from explicit reports, such as phone geofences. An arrival pins
+	// somebody home until they leave or the pin runs out.
+	Pinned        bool
+	pinned_until  time.Time
+	LeftAt        time.Time
+	NearUntil     time.Time
+	pin_source    string
+	skip_debounce bool
+	// Secret a person's phone uses to report their presence
+	presence_token string
+}
+
+// Record a sighting of one of this housemate's devices
+func (h *Housemate) sawDevice(d *Device, seen time.Time, source string) {
+	if !seen.After(d.Last_seen) {
+		return
+	}
+	d.Last_seen = seen
+	d.Source = source
+	if d.CountsForPresence && !seen.Before(h.Last_seen) {
+		h.Last_seen = seen
+		h.LastDevice = d
+	}
 }
 
 func (h *Housemate) isHome() bool {
-	time_since_last_seen := time.Now().Sub(h.Last_seen)
-	is_home := time_since_last_seen < (time.Minute * 10)
-	return is_home
+	return h.Home
 }
 
 type DhcpStatus struct {
-	db         *sql.DB
+	db *sql.DB
+	// Owned by the presence loop; everything else should use Snapshot()
 	housemates []*Housemate
+	sources    []PresenceSource
 	Last_ping  time.Time
+
+	snapshot_mutex sync.RWMutex
+	snapshot       *PresenceSnapshot
+
+	subscribers_mutex sync.Mutex
+	subscribers       []chan *PresenceEvent
+	// Events from this pass of the presence loop, owned by the loop
+	pending_events []*PresenceEvent
+	// Whether guests were home as of the last pass, owned by the loop
+	guests_home bool
+
+	unknown_mutex sync.Mutex
+	unknown       map[string]*UnknownDevice
+
+	reports chan *PresenceReport
+	reloads chan chan error
+
+	source_mutex  sync.Mutex
+	source_health map[string]*PresenceSourceHealth
+}
+
+// How a presence source is getting on
+type PresenceSourceHealth struct {
+	Name            string
+	Running         bool
+	Restarts        int
+	LastObservation time.Time
 }
 
 func NewDhcpStatus(c *Config) *DhcpStatus {
@@ -45,114 +136,378 @@ func NewDhcpStatus(c *Config) *DhcpStatus {
 		log.Println(err)
 	}
 	t.db = db
+	t.sources = NewPresenceSources(c)
+	t.unknown = make(map[string]*UnknownDevice)
+	t.reports = make(chan *PresenceReport, PRESENCE_SUBSCRIBER_BUFFER)
+	t.reloads = make(chan chan error)
+	t.snapshot = new(PresenceSnapshot)
+	t.source_health = make(map[string]*PresenceSourceHealth)
+	for _, source := range t.sources {
+		t.source_health[source.Name()] = &PresenceSourceHealth{Name: source.Name()}
+	}
 
 	return t
 }
 
-func (t *DhcpStatus) LastPersonActive() *Housemate {
-	if len(t.housemates) == 0 {
-		return nil
+// Health of each configured presence source, in config order
+func (t *DhcpStatus) SourceHealth() []PresenceSourceHealth {
+	t.source_mutex.Lock()
+	defer t.source_mutex.Unlock()
+	health := make([]PresenceSourceHealth, 0, len(t.sources))
+	for _, source := range t.sources {
+		health = append(health, *t.source_health[source.Name()])
 	}
-	last_seen := t.housemates[0]
-	for _, person := range t.housemates {
-		if person.Last_seen.After(last_seen.Last_seen) {
-			last_seen = person
-		}
+	return health
+}
+
+func (t *DhcpStatus) updateSourceHealth(name string, update func(*PresenceSourceHealth)) {
+	t.source_mutex.Lock()
+	defer t.source_mutex.Unlock()
+	if health, ok := t.source_health[name]; ok {
+		update(health)
 	}
-	return last_seen
 }
 
-func (t *DhcpStatus) LoadMacs() error {
-	t.housemates = make([]*Housemate, 0)
+func (t *DhcpStatus) LastPersonActive() *Housemate {
+	return t.Snapshot().LastPersonActive()
+}
+
+func (t *DhcpStatus) AnybodyHome() bool {
+	return t.Snapshot().AnybodyHome()
+}
 
-	rows, err := t.db.Query("SELECT id, mac, name from nest.people")
+func (t *DhcpStatus) LoadMacs() error {
+	housemates, err := t.loadHousemates()
 	if err != nil {
 		log.Print(err)
 		return err
 	}
+	t.housemates = housemates
+	t.publishSnapshot(time.Now())
+	return nil
+}
+
+// Read everybody and their devices from the database, along with the presence
+// state saved before the last restart.
+func (t *DhcpStatus) loadHousemates() ([]*Housemate, error) {
+	housemates := make([]*Housemate, 0)
+
+	rows, err := t.db.Query(`SELECT p.id, p.name, p.away_timeout, p.debounce, p.presence_token,
+		p.pinned_until, p.pin_source,
+		d.id, d.label, d.mac, d.hostname, d.client_id, d.counts_for_presence,
+		d.last_seen, d.last_seen_source
+		FROM nest.people p LEFT JOIN nest.devices d ON d.person = p.id
+		ORDER BY p.id, d.id`)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
+	var h *Housemate
 	for rows.Next() {
-		h := new(Housemate)
+		var person_id int64
+		var name string
+		var away_timeout, debounce sql.NullInt64
+		var presence_token sql.NullString
+		var pinned_until sql.NullTime
+		var pin_source sql.NullString
+		var device_id sql.NullInt64
+		var label, mac, hostname, client_id sql.NullString
+		var counts sql.NullBool
+		var last_seen sql.NullTime
+		var last_seen_source sql.NullString
 		if err := rows.Scan(
-			&h.Id,
-			&h.Mac,
-			&h.Name,
+			&person_id,
+			&name,
+			&away_timeout,
+			&debounce,
+			&presence_token,
+			&pinned_until,
+			&pin_source,
+			&device_id,
+			&label,
+			&mac,
+			&hostname,
+			&client_id,
+			&counts,
+			&last_seen,
+			&last_seen_source,
 		); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if h == nil || h.Id != person_id {
+			h = new(Housemate)
+			h.Id = person_id
+			h.Name = name
+			h.AwayTimeout = PRESENCE_DEFAULT_AWAY_TIMEOUT
+			if away_timeout.Valid {
+				h.AwayTimeout = time.Duration(away_timeout.Int64) * time.Second
+			}
+			h.Debounce = time.Duration(debounce.Int64) * time.Second
+			h.custom_away_timeout = away_timeout.Valid
+			h.custom_debounce = debounce.Valid
+			h.presence_token = presence_token.String
+			if pinned_until.Valid {
+				h.Pinned = true
+				h.pinned_until = pinned_until.Time
+				h.pin_source = pin_source.String
+			}
+			housemates = append(housemates, h)
+		}
+
+		// People may not have any devices yet
+		if !device_id.Valid {
 			continue
 		}
-		h.Last_seen = time.Now().Round(time.Second)
-		t.housemates = append(t.housemates, h)
+		d := new(Device)
+		d.Id = device_id.Int64
+		d.Label = label.String
+		if mac.Valid {
+			d.Mac = normaliseMac(mac.String)
+			if d.Mac == "" {
+				log.Println("Ignoring bad MAC", mac.String, "for device", d.Id)
+			}
+		}
+		d.Hostname = hostname.String
+		d.ClientId = normaliseClientId(client_id.String)
+		d.CountsForPresence = counts.Bool
+		h.Devices = append(h.Devices, d)
+
+		// Pick up where we left off before the last restart
+		if last_seen.Valid {
+			h.sawDevice(d, last_seen.Time, last_seen_source.String)
+			d.persisted = d.Last_seen
+		}
 	}
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, housemate := range housemates {
+		if err := t.loadPresenceState(housemate); err != nil {
+			log.Println(err)
+		}
+	}
+	return housemates, nil
 }
 
-type SyslogLine struct {
-	Timestamp time.Time
-	Host      string
-	Tag       string
-	Message   string
-}
-
-func undoubleSpaces(line string) string {
-	chars := make([]rune, 0)
-	i_c := 0
-	for i, c := range line {
-		if i == 0 {
-			chars = append(chars, c)
-			i_c++
-		} else {
-			if c == ' ' {
-				if chars[i_c-1] != ' ' {
-					chars = append(chars, c)
-					i_c++
-				}
-			} else {
-				chars = append(chars, c)
-				i_c++
-			}
+// Only log every so many malformed lines, in case syslog is full of them
+const SYSLOG_MALFORMED_LOG_EVERY = 1000
+
+// Checks syslog lines from the DHCP server for MACs. Shared by everything
+// that reads syslog, whether from a file or the network.
+type SyslogMatcher struct {
+	lines     uint64
+	malformed uint64
+	programs  []string
+	source    string
+}
+
+func NewSyslogMatcher(programs []string, source string) *SyslogMatcher {
+	t := new(SyslogMatcher)
+	t.programs = programs
+	t.source = source
+	return t
+}
+
+// Number of lines read, and how many of them couldn't be parsed
+func (t *SyslogMatcher) Counts() (uint64, uint64) {
+	return atomic.LoadUint64(&t.lines), atomic.LoadUint64(&t.malformed)
+}
+
+func (t *SyslogMatcher) Match(line string, observations chan<- *PresenceObservation) {
+	t.MatchSince(line, time.Time{}, observations)
+}
+
+// Match a line, ignoring it if it was logged before the given time
+func (t *SyslogMatcher) MatchSince(line string, since time.Time, observations chan<- *PresenceObservation) {
+	if observation := t.observe(line, since); observation != nil {
+		observations <- observation
+	}
+}
+
+// The client a line from the DHCP server mentions, if any
+func (t *SyslogMatcher) observe(line string, since time.Time) *PresenceObservation {
+	atomic.AddUint64(&t.lines, 1)
+	logline, err := parseSyslogLine(line, time.Local, time.Now())
+	if err != nil {
+		malformed := atomic.AddUint64(&t.malformed, 1)
+		if malformed%SYSLOG_MALFORMED_LOG_EVERY == 1 {
+			log.Printf("Skipping malformed syslog line (%d so far): %q", malformed, line)
 		}
+		return nil
 	}
-	return string(chars)
+	if logline.Timestamp.Before(since) || !matchesProgram(t.programs, logline.Program) {
+		return nil
+	}
+	message := parseDhcpMessage(logline.Message)
+	if message == nil {
+		return nil
+	}
+	return &PresenceObservation{
+		Mac:      message.Mac,
+		Hostname: message.Hostname,
+		ClientId: message.ClientId,
+		Time:     logline.Timestamp,
+		Source:   t.source,
+	}
+}
+
+type SyslogSource struct {
+	path    string
+	matcher *SyslogMatcher
 }
 
-func parseSyslogLine(line string) *SyslogLine {
-	line = undoubleSpaces(line)
-	split_line := strings.Split(line, " ")
-	l := new(SyslogLine)
-	l.Timestamp = time.Now().Round(time.Second)
-	l.Host = split_line[3]
-	l.Tag = split_line[4]
-	l.Message = strings.Join(split_line[4:], " ")
-	return l
+func NewSyslogSource(path string, programs []string) *SyslogSource {
+	t := new(SyslogSource)
+	t.path = path
+	t.matcher = NewSyslogMatcher(programs, t.Name())
+	return t
+}
 
+func (t *SyslogSource) Name() string {
+	return PRESENCE_SOURCE_SYSLOG
 }
 
-func (t *DhcpStatus) FollowLog() {
+func (t *SyslogSource) Run(observations chan<- *PresenceObservation) error {
 	for {
-		// Open syslog for tailing
-		tailer, err := tail.TailFile("/var/log/syslog", tail.Config{
-			Follow: true,
-			ReOpen: true,
-			Poll:   true,
+		// Open syslog for tailing. Older lines are picked up by Backfill.
+		tailer, err := tail.TailFile(t.path, tail.Config{
+			Location: &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd},
+			Follow:   true,
+			ReOpen:   true,
+			Poll:     true,
 		})
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
 
 		// Iterate over tailed lines, check if they belong to dhcpd
 		for line := range tailer.Lines {
-			logline := parseSyslogLine(line.Text)
-			// If the logline is DHCPD's, check it for known MACs
-			if logline.Tag == "dhcpd:" {
-				for _, housemate := range t.housemates {
-					if strings.Contains(logline.Message, housemate.Mac) {
-						housemate.Last_seen = logline.Timestamp
+			t.matcher.Match(line.Text, observations)
+		}
+		log.Println("Tailer reloaded")
+	}
+}
+
+// Read lines logged since the given time, including the most recent rotation
+// in case it happened in that window.
+func (t *SyslogSource) Backfill(since time.Time, observations chan<- *PresenceObservation) error {
+	for _, path := range []string{t.path + ".1", t.path} {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			t.matcher.MatchSince(scanner.Text(), since, observations)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run all the configured presence sources, marking housemates as seen
+// whenever any of them spots one of their devices.
+func (t *DhcpStatus) FollowSources() {
+	observations := make(chan *PresenceObservation)
+	since := t.backfillSince(time.Now())
+
+	// Nobody arrives or leaves until every source has caught up, so that a
+	// sighting still to be backfilled can't be taken for an absence
+	var backfills sync.WaitGroup
+	for _, source := range t.sources {
+		if _, ok := source.(BackfillingSource); ok {
+			backfills.Add(1)
+		}
+	}
+	backfilled := make(chan bool)
+	go func() {
+		backfills.Wait()
+		close(backfilled)
+	}()
+
+	for _, source := range t.sources {
+		go func(source PresenceSource, since time.Time) {
+			first := true
+			for {
+				// Catch up on anything we missed while not running
+				if backfiller, ok := source.(BackfillingSource); ok {
+					if err := backfiller.Backfill(since, observations); err != nil {
+						log.Println("Presence source", source.Name(), "backfill failed:", err)
+					}
+					if first {
+						backfills.Done()
+						first = false
 					}
 				}
+				t.updateSourceHealth(source.Name(), func(h *PresenceSourceHealth) {
+					h.Running = true
+				})
+				err := source.Run(observations)
+				log.Println("Presence source", source.Name(), "stopped:", err)
+				t.updateSourceHealth(source.Name(), func(h *PresenceSourceHealth) {
+					h.Running = false
+					h.Restarts++
+				})
+				since = time.Now()
+				time.Sleep(time.Minute)
 			}
+		}(source, since)
+	}
+
+	// Check presence on every sighting, so arrivals are noticed straight
+	// away, and periodically so that departures are too.
+	ticker := time.NewTicker(PRESENCE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	backfilling := true
+	for {
+		select {
+		case <-backfilled:
+			backfilling = false
+			backfilled = nil
+		case observation := <-observations:
+			observation.Mac = normaliseMac(observation.Mac)
+			observation.ClientId = normaliseClientId(observation.ClientId)
+			t.updateSourceHealth(observation.Source, func(h *PresenceSourceHealth) {
+				if observation.Time.After(h.LastObservation) {
+					h.LastObservation = observation.Time
+				}
+			})
+			known := false
+			for _, housemate := range t.housemates {
+				for _, device := range housemate.Devices {
+					if device.matches(observation) {
+						housemate.sawDevice(device, observation.Time, observation.Source)
+						known = true
+					}
+				}
+			}
+			if !known {
+				t.sawUnknown(observation)
+			}
+		case report := <-t.reports:
+			t.applyReport(report)
+		case done := <-t.reloads:
+			done <- t.reloadHousemates()
+		case <-ticker.C:
+			t.persistPresence()
+			t.persistUnknown()
 		}
-		log.Println("Tailer reloaded")
+		now := time.Now()
+		if !backfilling {
+			t.updatePresence(now)
+		}
+		t.publishSnapshot(now)
+		t.flushEvents()
 	}
 }
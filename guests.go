@@ -0,0 +1,238 @@
+/*
+Guest detection
+
+Keeps track of DHCP clients that don't belong to any housemate. When guest
+mode is on, recently seen unknown devices count toward the house being
+occupied. Unknown devices can be promoted to a housemate's device, or ignored.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+type UnknownDevice struct {
+	Id         int64
+	Mac        string
+	Hostname   string
+	First_seen time.Time
+	Last_seen  time.Time
+	Ignored    bool
+	persisted  time.Time
+}
+
+var errNameRequired = errors.New("A name is needed for a new housemate")
+
+// Only DHCP traffic is a reliable sign of a new visitor; the ARP table is
+// full of fixed infrastructure.
+func isGuestSource(source string) bool {
+	return source != PRESENCE_SOURCE_ARP
+}
+
+func (t *DhcpStatus) LoadUnknownDevices() error {
+	rows, err := t.db.Query(`SELECT id, mac, hostname, first_seen, last_seen, ignored
+		FROM nest.unknown_devices`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	unknown := make(map[string]*UnknownDevice)
+	for rows.Next() {
+		u := new(UnknownDevice)
+		var hostname sql.NullString
+		if err := rows.Scan(
+			&u.Id,
+			&u.Mac,
+			&hostname,
+			&u.First_seen,
+			&u.Last_seen,
+			&u.Ignored,
+		); err != nil {
+			log.Println(err)
+			continue
+		}
+		u.Hostname = hostname.String
+		u.persisted = u.Last_seen
+		unknown[normaliseMac(u.Mac)] = u
+	}
+
+	t.unknown_mutex.Lock()
+	t.unknown = unknown
+	t.unknown_mutex.Unlock()
+	return rows.Err()
+}
+
+// Note a sighting that didn't match any housemate's device
+func (t *DhcpStatus) sawUnknown(observation *PresenceObservation) {
+	if observation.Mac == "" || !isGuestSource(observation.Source) {
+		return
+	}
+
+	t.unknown_mutex.Lock()
+	defer t.unknown_mutex.Unlock()
+
+	key := observation.Mac
+	u, ok := t.unknown[key]
+	if !ok {
+		u = new(UnknownDevice)
+		u.Mac = key
+		u.First_seen = observation.Time
+		t.unknown[key] = u
+		log.Println("New unknown device", u.Mac, observation.Hostname)
+	}
+	if observation.Hostname != "" {
+		u.Hostname = observation.Hostname
+	}
+	if observation.Time.After(u.Last_seen) {
+		u.Last_seen = observation.Time
+	}
+}
+
+func (t *DhcpStatus) persistUnknown() {
+	t.unknown_mutex.Lock()
+	defer t.unknown_mutex.Unlock()
+
+	for _, u := range t.unknown {
+		if !u.Last_seen.After(u.persisted) {
+			continue
+		}
+		_, err := t.db.Exec(`INSERT INTO nest.unknown_devices
+			(mac, hostname, first_seen, last_seen, ignored)
+			VALUES (?, NULLIF(?, ''), ?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+			hostname = COALESCE(VALUES(hostname), hostname),
+			last_seen = GREATEST(last_seen, VALUES(last_seen)),
+			ignored = GREATEST(ignored, VALUES(ignored))`,
+			u.Mac, u.Hostname, u.First_seen.UTC(), u.Last_seen.UTC(), u.Ignored,
+		)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		u.persisted = u.Last_seen
+	}
+}
+
+// Copies of all unknown devices, most recently seen first
+func (t *DhcpStatus) UnknownDevices() []*UnknownDevice {
+	t.unknown_mutex.Lock()
+	defer t.unknown_mutex.Unlock()
+
+	devices := make([]*UnknownDevice, 0, len(t.unknown))
+	for _, u := range t.unknown {
+		device := *u
+		devices = append(devices, &device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Last_seen.After(devices[j].Last_seen)
+	})
+	return devices
+}
+
+// Whether any unknown device that hasn't been ignored was seen recently
+func (t *DhcpStatus) GuestsHome() bool {
+	t.unknown_mutex.Lock()
+	defer t.unknown_mutex.Unlock()
+
+	now := time.Now()
+	for _, u := range t.unknown {
+		if !u.Ignored && now.Sub(u.Last_seen) < PRESENCE_DEFAULT_AWAY_TIMEOUT {
+			return true
+		}
+	}
+	return false
+}
+
+// Ignore a device from now on. The row is created if the device hasn't been
+// written out yet, so the choice survives a restart.
+func (t *DhcpStatus) IgnoreUnknown(mac string) error {
+	mac = normaliseMac(mac)
+	t.unknown_mutex.Lock()
+	defer t.unknown_mutex.Unlock()
+
+	now := time.Now()
+	u, ok := t.unknown[mac]
+	if !ok {
+		u = &UnknownDevice{Mac: mac, First_seen: now, Last_seen: now}
+	}
+	_, err := t.db.Exec(`INSERT INTO nest.unknown_devices
+		(mac, hostname, first_seen, last_seen, ignored)
+		VALUES (?, NULLIF(?, ''), ?, ?, 1)
+		ON DUPLICATE KEY UPDATE ignored = 1`,
+		u.Mac, u.Hostname, u.First_seen.UTC(), u.Last_seen.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	u.Ignored = true
+	t.unknown[mac] = u
+	return nil
+}
+
+// Turn an unknown device into one belonging to a housemate. If person_id is
+// zero, a new housemate is created with the given name. Only the MAC is used
+// to recognise it; the hostname just becomes its label, since generic names
+// like "iPhone" would match every visitor's phone too.
+func (t *DhcpStatus) PromoteUnknown(mac string, person_id int64, name, label string) error {
+	mac = normaliseMac(mac)
+	if mac == "" {
+		return errBadMac
+	}
+	t.unknown_mutex.Lock()
+	u, ok := t.unknown[mac]
+	var hostname string
+	if ok {
+		hostname = u.Hostname
+	}
+	t.unknown_mutex.Unlock()
+	if label == "" {
+		label = hostname
+	}
+	if label == "" {
+		label = mac
+	}
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if person_id == 0 {
+		res, err := tx.Exec(`INSERT INTO nest.people (name) VALUES (?)`, name)
+		if err != nil {
+			return err
+		}
+		person_id, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO nest.devices
+		(person, label, mac, counts_for_presence)
+		VALUES (?, ?, ?, 1)`,
+		person_id, label, mac,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM nest.unknown_devices WHERE mac = ?`, mac)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	t.unknown_mutex.Lock()
+	delete(t.unknown, mac)
+	t.unknown_mutex.Unlock()
+
+	return t.Reload()
+}
@@ -0,0 +1,361 @@
+/*
+Readings ingest pipeline
+
+Readings from the base station are put on a bounded in-memory queue and
+written to the database in batches. If the database can't be reached, or the
+queue fills up, readings are spooled to disk and replayed with their original
+timestamps once the database is back.
+*/
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	_ "github.com/go-sql-driver/mysql"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const INGEST_DEFAULT_QUEUE_SIZE = 1000
+const INGEST_DEFAULT_BATCH_SIZE = 50
+const INGEST_DEFAULT_SPOOL_PATH = "ernest_spool.jsonl"
+const INGEST_MIN_BACKOFF = time.Second
+const INGEST_MAX_BACKOFF = time.Minute
+
+type QueuedReading struct {
+	Time     time.Time
+	Node     int64
+	Temp     sql.NullFloat64
+	Pressure sql.NullFloat64
+	Humidity sql.NullFloat64
+	// Anything else the node measured, such as its battery voltage
+	Metrics map[string]float64 `json:",omitempty"`
+}
+
+type IngestStats struct {
+	Queued    int
+	Spooled   int
+	Lag       time.Duration
+	LastError string
+}
+
+type ReadingIngest struct {
+	db         *sql.DB
+	queue      chan *QueuedReading
+	batch_size int
+	spool_path string
+
+	// Guards everything below, as well as the spool file itself
+	mutex        sync.Mutex
+	inflight     []*QueuedReading
+	spooled      int
+	spool_oldest time.Time
+	last_error   error
+}
+
+func NewReadingIngest(c *Config) *ReadingIngest {
+	t := new(ReadingIngest)
+
+	db, err := sql.Open("mysql", c.GetSqlURI())
+	if err != nil {
+		log.Println(err)
+	}
+	t.db = db
+
+	queue_size := c.Ingest.QueueSize
+	if queue_size <= 0 {
+		queue_size = INGEST_DEFAULT_QUEUE_SIZE
+	}
+	t.queue = make(chan *QueuedReading, queue_size)
+
+	t.batch_size = c.Ingest.BatchSize
+	if t.batch_size <= 0 {
+		t.batch_size = INGEST_DEFAULT_BATCH_SIZE
+	}
+
+	t.spool_path = c.Ingest.SpoolPath
+	if t.spool_path == "" {
+		t.spool_path = INGEST_DEFAULT_SPOOL_PATH
+	}
+
+	// Pick up anything left in the spool from a previous run
+	spooled, err := t.readSpool()
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	t.spooled = len(spooled)
+	if len(spooled) > 0 {
+		t.spool_oldest = spooled[0].Time
+		log.Println("Found", len(spooled), "spooled readings")
+	}
+
+	return t
+}
+
+// Queue a reading to be written. Never blocks; if the queue is full the
+// reading goes straight to the spool.
+func (t *ReadingIngest) Enqueue(r *QueuedReading) {
+	select {
+	case t.queue <- r:
+	default:
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if err := t.appendSpool([]*QueuedReading{r}); err != nil {
+			log.Println("Dropping reading, failed to spool:", err)
+		}
+	}
+}
+
+func (t *ReadingIngest) Stats() *IngestStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats := new(IngestStats)
+	stats.Queued = len(t.queue) + len(t.inflight)
+	stats.Spooled = t.spooled
+
+	var oldest time.Time
+	if len(t.inflight) > 0 {
+		oldest = t.inflight[0].Time
+	}
+	if t.spooled > 0 && (oldest.IsZero() || t.spool_oldest.Before(oldest)) {
+		oldest = t.spool_oldest
+	}
+	if !oldest.IsZero() {
+		stats.Lag = time.Now().Round(time.Second).Sub(oldest.Round(time.Second))
+	}
+
+	if t.last_error != nil && stats.Queued+stats.Spooled > 0 {
+		stats.LastError = t.last_error.Error()
+	}
+	return stats
+}
+
+func (t *ReadingIngest) Run() {
+	backoff := INGEST_MIN_BACKOFF
+	for {
+		// Wait for something to write, periodically checking on the spool
+		var batch []*QueuedReading
+		select {
+		case r := <-t.queue:
+			batch = append(batch, r)
+		case <-time.After(backoff):
+		}
+	drain:
+		for len(batch) > 0 && len(batch) < t.batch_size {
+			select {
+			case r := <-t.queue:
+				batch = append(batch, r)
+			default:
+				break drain
+			}
+		}
+
+		t.mutex.Lock()
+		t.inflight = batch
+		t.mutex.Unlock()
+
+		// Replay older spooled readings first, so that rows stay in order
+		err := t.replaySpool()
+		if err == nil {
+			err = t.insertBatch(batch)
+		}
+
+		t.mutex.Lock()
+		if err != nil {
+			log.Println(err)
+			metrics.CountDbError(DB_COMPONENT_INGEST)
+			t.last_error = err
+			if len(t.inflight) > 0 {
+				if serr := t.appendSpool(t.inflight); serr != nil {
+					log.Println("Dropping readings, failed to spool:", serr)
+				}
+			}
+		}
+		t.inflight = nil
+		t.mutex.Unlock()
+
+		if err != nil {
+			backoff *= 2
+			if backoff > INGEST_MAX_BACKOFF {
+				backoff = INGEST_MAX_BACKOFF
+			}
+		} else {
+			backoff = INGEST_MIN_BACKOFF
+		}
+	}
+}
+
+func (t *ReadingIngest) insertBatch(batch []*QueuedReading) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, 0, len(batch))
+	args := make([]interface{}, 0, len(batch)*5)
+	for _, r := range batch {
+		placeholders = append(placeholders, "(NULL, ?, ?, ?, ?, ?)")
+		args = append(args,
+			r.Time.UTC(),
+			r.Node, r.Temp, r.Pressure, r.Humidity,
+		)
+	}
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO  nest.readings
+		(id, timestamp, node_id, temp, pressure, humidity)
+		VALUES `+strings.Join(placeholders, ", "), args...)
+	if err != nil {
+		return err
+	}
+
+	// Extra metrics go in with the readings, so a retry can't duplicate either
+	placeholders = placeholders[:0]
+	args = args[:0]
+	for _, r := range batch {
+		for name, value := range r.Metrics {
+			placeholders = append(placeholders, "(?, ?, ?, ?)")
+			args = append(args, r.Time.UTC(), r.Node, name, value)
+		}
+	}
+	if len(placeholders) > 0 {
+		_, err = tx.Exec(`INSERT INTO  nest.reading_metrics
+			(timestamp, node_id, metric, value)
+			VALUES `+strings.Join(placeholders, ", "), args...)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Write everything in the spool to the database. Anything that can't be
+// written is left in the spool for next time. The mutex isn't held while
+// writing, so a hung database doesn't hold up Stats or Enqueue.
+func (t *ReadingIngest) replaySpool() error {
+	t.mutex.Lock()
+	if t.spooled == 0 {
+		t.mutex.Unlock()
+		return nil
+	}
+	spooled, err := t.readSpool()
+	t.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	written := 0
+	for written < len(spooled) {
+		n := t.batch_size
+		if n > len(spooled)-written {
+			n = len(spooled) - written
+		}
+		if err = t.insertBatch(spooled[written : written+n]); err != nil {
+			break
+		}
+		written += n
+	}
+	if written == 0 {
+		return err
+	}
+
+	// Readings spooled since are appended, so the written ones are still at
+	// the front
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	current, rerr := t.readSpool()
+	if rerr != nil {
+		return rerr
+	}
+	if written > len(current) {
+		written = len(current)
+	}
+	if werr := t.writeSpool(current[written:]); werr != nil {
+		return werr
+	}
+	if err == nil {
+		log.Println("Replayed spooled readings")
+	}
+	return err
+}
+
+// Must hold the mutex
+func (t *ReadingIngest) readSpool() ([]*QueuedReading, error) {
+	f, err := os.Open(t.spool_path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	readings := make([]*QueuedReading, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := new(QueuedReading)
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			log.Println("Skipping bad spool line:", err)
+			continue
+		}
+		readings = append(readings, r)
+	}
+	return readings, scanner.Err()
+}
+
+// Must hold the mutex
+func (t *ReadingIngest) appendSpool(readings []*QueuedReading) error {
+	f, err := os.OpenFile(t.spool_path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, r := range readings {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+		if t.spooled == 0 || r.Time.Before(t.spool_oldest) {
+			t.spool_oldest = r.Time
+		}
+		t.spooled++
+	}
+	return f.Sync()
+}
+
+// Replace the spool contents. Must hold the mutex
+func (t *ReadingIngest) writeSpool(readings []*QueuedReading) error {
+	tmp_path := t.spool_path + ".tmp"
+	f, err := os.Create(tmp_path)
+	if err != nil {
+		return err
+	}
+
+	t.spooled = 0
+	enc := json.NewEncoder(f)
+	for _, r := range readings {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+		if t.spooled == 0 || r.Time.Before(t.spool_oldest) {
+			t.spool_oldest = r.Time
+		}
+		t.spooled++
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp_path, t.spool_path)
+}
@@ -0,0 +1,199 @@
+/*
+Live status events
+
+Pushes changes to the status page as Server-Sent Events from /events: new
+readings, the furnace turning on or off, override and setting changes, and
+people arriving and leaving. Each event's data is JSON in the same shapes as
+the JSON API.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const LIVE_EVENT_READING = "reading"
+const LIVE_EVENT_FURNACE = "furnace"
+const LIVE_EVENT_OVERRIDE = "override"
+const LIVE_EVENT_SETTING = "setting"
+const LIVE_EVENT_PRESENCE = "presence"
+
+// Events waiting for a slow client before it's disconnected
+const LIVE_EVENT_BUFFER = 32
+
+// Comments are sent this often so proxies don't close idle streams
+const LIVE_EVENT_KEEPALIVE = 30 * time.Second
+
+type LiveEvent struct {
+	Id   int64
+	Type string
+	Data []byte
+}
+
+type ApiFurnace struct {
+	On bool `json:"on"`
+}
+
+type ApiPresenceChange struct {
+	Event    *ApiPresenceEvent `json:"event"`
+	Presence *ApiPresence      `json:"presence"`
+}
+
+// Fans events out to every connected client
+type LiveEvents struct {
+	mutex       sync.Mutex
+	next_id     int64
+	subscribers map[chan *LiveEvent]bool
+}
+
+func NewLiveEvents() *LiveEvents {
+	t := new(LiveEvents)
+	t.subscribers = make(map[chan *LiveEvent]bool)
+	return t
+}
+
+func (t *LiveEvents) Subscribe() chan *LiveEvent {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ch := make(chan *LiveEvent, LIVE_EVENT_BUFFER)
+	t.subscribers[ch] = true
+	return ch
+}
+
+func (t *LiveEvents) Unsubscribe(ch chan *LiveEvent) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.subscribers[ch] {
+		delete(t.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Whether it's worth building events at all
+func (t *LiveEvents) Listening() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.subscribers) > 0
+}
+
+// Send an event to everybody. Clients that have fallen behind are cut off,
+// and catch up by reloading when they reconnect.
+func (t *LiveEvents) Publish(event_type string, data interface{}) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.next_id++
+	event := &LiveEvent{t.next_id, event_type, encoded}
+	for ch := range t.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Println("Live event client is full, disconnecting it")
+			delete(t.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (d *Decider) publishReading(reading *QueuedReading) {
+	if !d.events.Listening() {
+		return
+	}
+	node := &ApiNode{
+		Id:   reading.Node,
+		Name: d.nodeName(reading.Node),
+		LastReading: &ApiReading{
+			Time:     reading.Time,
+			Temp:     rawMetric(reading.Temp),
+			Pressure: rawMetric(reading.Pressure),
+			Humidity: rawMetric(reading.Humidity),
+		},
+	}
+	if primary, err := d.settings.GetInt(SETTING_PRIMARY_NODE); err == nil {
+		node.Primary = primary == reading.Node
+	}
+	d.events.Publish(LIVE_EVENT_READING, node)
+}
+
+func (d *Decider) publishSetting(key, value string) {
+	if !d.events.Listening() {
+		return
+	}
+	switch key {
+	case SETTING_FURNACE_ON:
+		d.events.Publish(LIVE_EVENT_FURNACE, &ApiFurnace{value == "1"})
+	case SETTING_OVERRIDE:
+		d.events.Publish(LIVE_EVENT_OVERRIDE, d.getApiOverride())
+	default:
+		def, err := lookupSetting(key)
+		if err != nil {
+			return
+		}
+		d.events.Publish(LIVE_EVENT_SETTING, apiSetting(def, value, nil))
+	}
+}
+
+func (d *Decider) publishPresence(event *PresenceEvent) {
+	if !d.events.Listening() {
+		return
+	}
+	d.events.Publish(LIVE_EVENT_PRESENCE, &ApiPresenceChange{
+		Event: &ApiPresenceEvent{
+			Time:     event.Time,
+			PersonId: event.PersonId,
+			Name:     event.Name,
+			Event:    event.Type,
+			Device:   event.Device,
+		},
+		Presence: d.getApiPresence(),
+	})
+}
+
+// Streams live events until the client goes away
+func (t *WebServer) EventsPage(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := t.decider.events.Subscribe()
+	defer t.decider.events.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx holding events back
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(LIVE_EVENT_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, event.Data)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
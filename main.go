@@ -1,20 +1,79 @@
 package main
 
 import (
+	"bufio"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	backfill_presence := flag.Bool("backfill-presence", false,
+		"Rebuild people_history from old syslog files, then exit")
+	backfill_logs := flag.String("backfill-logs", BACKFILL_DEFAULT_LOGS,
+		"Syslog files to backfill presence from")
+	add_user := flag.String("add-user", "",
+		"Add a web user, reading their password from stdin, then exit")
+	can_control := flag.Bool("control", false,
+		"Let the user added with -add-user change settings, not just look")
+	set_password := flag.String("set-password", "",
+		"Reset a web user's password, reading it from stdin, then exit")
+	flag.Parse()
+
 	config := LoadConfiguration("gonest.gcfg")
 
+	if *backfill_presence {
+		if err := NewPresenceBackfill(config).Run(*backfill_logs); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *add_user != "" || *set_password != "" {
+		auth := NewAuthStore(config)
+		var err error
+		if password, read_err := readPassword(); read_err != nil {
+			err = read_err
+		} else if *add_user != "" {
+			err = auth.CreateUser(*add_user, password, *can_control)
+		} else {
+			err = auth.SetPasswordByName(*set_password, password)
+		}
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	dhcp_watcher := NewDhcpStatus(config)
 	dhcp_watcher.LoadMacs()
-	go dhcp_watcher.FollowLog()
+	if err := dhcp_watcher.LoadUnknownDevices(); err != nil {
+		log.Println(err)
+	}
+	go dhcp_watcher.FollowSources()
+
+	ingest := NewReadingIngest(config)
+	go ingest.Run()
 
-	decider := NewDecider(config, dhcp_watcher)
+	decider := NewDecider(config, dhcp_watcher, ingest)
+	go decider.settings.Run()
+	go decider.WatchPresence()
+	go decider.WatchNodeNames()
+
+	if len(config.Presence.EventWebhook) > 0 {
+		webhooks := NewPresenceWebhooks(config, dhcp_watcher)
+		go webhooks.Run()
+	}
+
+	rollups := NewReadingRollups(config)
+	go rollups.Run()
 
 	webserver := NewWebServer(config, dhcp_watcher, decider)
 
@@ -30,3 +89,13 @@ func main() {
 	}
 
 }
+
+// Read a password from the first line of stdin
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
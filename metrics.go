@@ -0,0 +1,220 @@
+/*
+Prometheus metrics
+
+Serves /metrics in the Prometheus text format. Gauges are read from what the
+decider and presence loop already hold when scraped, so scrapes don't add
+database load beyond the settings store's cache. Counters are kept here.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const METRICS_PATH = "/metrics"
+
+// Components whose database errors are counted
+const DB_COMPONENT_INGEST = "ingest"
+const DB_COMPONENT_SETTINGS = "settings"
+const DB_COMPONENT_API = "api"
+
+type MetricsCounters struct {
+	mutex             sync.Mutex
+	control_responses map[string]int64
+	db_errors         map[string]int64
+}
+
+var metrics = NewMetricsCounters()
+
+func NewMetricsCounters() *MetricsCounters {
+	t := new(MetricsCounters)
+	t.control_responses = make(map[string]int64)
+	t.db_errors = make(map[string]int64)
+	return t
+}
+
+func (t *MetricsCounters) CountControlResponse(token string) {
+	t.mutex.Lock()
+	t.control_responses[token]++
+	t.mutex.Unlock()
+}
+
+func (t *MetricsCounters) CountDbError(component string) {
+	t.mutex.Lock()
+	t.db_errors[component]++
+	t.mutex.Unlock()
+}
+
+func copyCounts(counts map[string]int64) map[string]int64 {
+	c := make(map[string]int64, len(counts))
+	for k, v := range counts {
+		c[k] = v
+	}
+	return c
+}
+
+func (t *MetricsCounters) snapshot() (map[string]int64, map[string]int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return copyCounts(t.control_responses), copyCounts(t.db_errors)
+}
+
+// Writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	w io.Writer
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// A sample, with labels given as name, value pairs
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprint(m.w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+metricsLabelEscaper.Replace(labels[i+1])+`"`)
+		}
+		fmt.Fprint(m.w, "{"+strings.Join(pairs, ",")+"}")
+	}
+	fmt.Fprintln(m.w, " "+strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (m *metricsWriter) gauge(name, help string, value float64) {
+	m.header(name, "gauge", help)
+	m.sample(name, value)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func (m *metricsWriter) counts(name, help, label string, counts map[string]int64) {
+	m.header(name, "counter", help)
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		m.sample(name, float64(counts[k]), label, k)
+	}
+}
+
+func (t *WebServer) MetricsPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := &metricsWriter{w}
+	now := time.Now()
+
+	// Nodes
+	readings := t.decider.latestReadings()
+	node_metrics := []struct {
+		name  string
+		help  string
+		value func(*QueuedReading) (float64, bool)
+	}{
+		{"ernest_node_temperature_celsius", "Latest temperature reported by a node",
+			func(r *QueuedReading) (float64, bool) { return r.Temp.Float64, r.Temp.Valid }},
+		{"ernest_node_pressure_mbar", "Latest pressure reported by a node",
+			func(r *QueuedReading) (float64, bool) { return r.Pressure.Float64, r.Pressure.Valid }},
+		{"ernest_node_humidity_percent", "Latest relative humidity reported by a node",
+			func(r *QueuedReading) (float64, bool) { return r.Humidity.Float64, r.Humidity.Valid }},
+		{"ernest_node_last_reading_timestamp_seconds", "When a node last reported",
+			func(r *QueuedReading) (float64, bool) { return unixSeconds(r.Time), true }},
+		{"ernest_node_reading_age_seconds", "How long since a node last reported",
+			func(r *QueuedReading) (float64, bool) { return now.Sub(r.Time).Seconds(), true }},
+	}
+	for _, metric := range node_metrics {
+		m.header(metric.name, "gauge", metric.help)
+		for _, reading := range readings {
+			if value, ok := metric.value(reading); ok {
+				m.sample(metric.name, value,
+					"node", strconv.FormatInt(reading.Node, 10), "name", t.decider.nodeName(reading.Node))
+			}
+		}
+	}
+
+	// Heating
+	m.gauge("ernest_furnace_on", "Whether the furnace was last told to turn on",
+		boolMetric(t.decider.getLastFurnaceState()))
+	m.header("ernest_setpoint_celsius", "gauge", "Temperature the house is kept at")
+	m.sample("ernest_setpoint_celsius", t.decider.getActiveTemp(), "mode", "occupied")
+	m.sample("ernest_setpoint_celsius", t.decider.getIdleTemp(), "mode", "unoccupied")
+	m.gauge("ernest_override_active", "Whether the heating override is on",
+		boolMetric(t.decider.getOverride()))
+
+	// Presence
+	snapshot := t.dhcp_tailer.Snapshot()
+	m.gauge("ernest_house_occupied", "Whether the house counts as occupied for heating",
+		boolMetric(t.decider.anybodyHome()))
+	people_home := 0
+	m.header("ernest_person_home", "gauge", "Whether a housemate is home")
+	for _, person := range snapshot.People {
+		if person.isHome() {
+			people_home++
+		}
+		m.sample("ernest_person_home", boolMetric(person.isHome()), "person", person.Name)
+	}
+	m.header("ernest_person_near", "gauge", "Whether a housemate is nearly home")
+	for _, person := range snapshot.People {
+		m.sample("ernest_person_near", boolMetric(person.isNear(now)), "person", person.Name)
+	}
+	m.gauge("ernest_people_home", "Number of housemates home", float64(people_home))
+	m.gauge("ernest_guests_home", "Whether unknown devices have been seen recently",
+		boolMetric(t.dhcp_tailer.GuestsHome()))
+
+	health := t.dhcp_tailer.SourceHealth()
+	m.header("ernest_presence_source_up", "gauge", "Whether a presence source is running")
+	for _, source := range health {
+		m.sample("ernest_presence_source_up", boolMetric(source.Running), "source", source.Name)
+	}
+	m.header("ernest_presence_source_restarts_total", "counter", "Times a presence source has stopped and been restarted")
+	for _, source := range health {
+		m.sample("ernest_presence_source_restarts_total", float64(source.Restarts), "source", source.Name)
+	}
+	m.header("ernest_presence_source_last_observation_timestamp_seconds", "gauge", "When a presence source last saw a device")
+	for _, source := range health {
+		if !source.LastObservation.IsZero() {
+			m.sample("ernest_presence_source_last_observation_timestamp_seconds",
+				unixSeconds(source.LastObservation), "source", source.Name)
+		}
+	}
+
+	// Base station, once it has reported over the JSON protocol
+	if uptime, last_seen := t.base_station.Uptime(); !last_seen.IsZero() {
+		m.gauge("ernest_base_station_uptime_seconds", "Base station uptime, as of its last report",
+			uptime+now.Sub(last_seen).Seconds())
+	}
+
+	// Server health
+	control_responses, db_errors := metrics.snapshot()
+	m.counts("ernest_control_requests_total", "Requests from the base station, by response",
+		"response", control_responses)
+	m.counts("ernest_db_errors_total", "Failed database operations", "component", db_errors)
+	m.gauge("ernest_settings_degraded", "Whether settings are being served from the local cache",
+		boolMetric(t.decider.settings.Health().Degraded))
+	ingest := t.decider.ingest.Stats()
+	m.gauge("ernest_ingest_queued", "Readings waiting to be written", float64(ingest.Queued))
+	m.gauge("ernest_ingest_spooled", "Readings spooled to disk while the database is unavailable",
+		float64(ingest.Spooled))
+	m.gauge("ernest_ingest_lag_seconds", "Age of the oldest reading not yet written", ingest.Lag.Seconds())
+	m.gauge("ernest_start_time_seconds", "When the server started", unixSeconds(t.server_started))
+}
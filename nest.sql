@@ -41,12 +41,54 @@ CREATE TABLE IF NOT EXISTS `history` (
 --
 -- Table structure for table `people`
 --
+-- To keep explicit arrivals across restarts in an existing table:
+--
+--   ALTER TABLE people ADD COLUMN pinned_until timestamp NULL DEFAULT NULL,
+--     ADD COLUMN pin_source varchar(64) DEFAULT NULL;
+--
 
 CREATE TABLE IF NOT EXISTS `people` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
-  `mac` char(17) NOT NULL,
   `name` varchar(256) NOT NULL,
-  PRIMARY KEY (`id`)
+  `away_timeout` int(11) DEFAULT NULL COMMENT 'Seconds unseen before marked away, default 600',
+  `debounce` int(11) DEFAULT NULL COMMENT 'Minimum seconds between presence transitions',
+  `presence_token` varchar(64) DEFAULT NULL COMMENT 'Secret for reporting presence from a phone',
+  `pinned_until` timestamp NULL DEFAULT NULL COMMENT 'When an explicit arrival stops counting',
+  `pin_source` varchar(64) DEFAULT NULL COMMENT 'What reported the explicit arrival',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `presence_token` (`presence_token`)
+) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `devices`
+--
+-- Each device belongs to a person, and is recognised by its MAC or its DHCP
+-- hostname, which may be a glob pattern, or its DHCP client identifier. To add
+-- client identifiers to an existing table:
+--
+--   ALTER TABLE devices ADD COLUMN client_id varchar(256) DEFAULT NULL AFTER hostname;
+--
+-- To move from the old single `people`.`mac` column:
+--
+--   INSERT INTO devices (person, label, mac, counts_for_presence)
+--     SELECT id, 'Phone', mac, 1 FROM people;
+--   ALTER TABLE people DROP COLUMN mac;
+--
+
+CREATE TABLE IF NOT EXISTS `devices` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `person` int(11) NOT NULL,
+  `label` varchar(256) NOT NULL,
+  `mac` char(17) DEFAULT NULL,
+  `hostname` varchar(256) DEFAULT NULL,
+  `client_id` varchar(256) DEFAULT NULL,
+  `counts_for_presence` tinyint(4) NOT NULL DEFAULT '1',
+  `last_seen` timestamp NULL DEFAULT NULL,
+  `last_seen_source` varchar(64) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `person` (`person`)
 ) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
 
 -- --------------------------------------------------------
@@ -65,6 +107,129 @@ CREATE TABLE IF NOT EXISTS `people_history` (
 
 -- --------------------------------------------------------
 
+--
+-- Table structure for table `presence_events`
+--
+
+CREATE TABLE IF NOT EXISTS `presence_events` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `person` int(11) NOT NULL,
+  `event` enum('arrive','leave','near') NOT NULL,
+  `device` varchar(256) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `person` (`person`,`timestamp`)
+) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
+
+-- --------------------------------------------------------
+
+--
+-- Raw readings are rolled up and pruned by time, which needs an index on
+-- `readings` in existing installs:
+--
+--   ALTER TABLE readings ADD KEY `timestamp` (`timestamp`);
+--
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `reading_metrics`
+--
+
+CREATE TABLE IF NOT EXISTS `reading_metrics` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `node_id` int(11) NOT NULL,
+  `metric` varchar(32) NOT NULL COMMENT 'Extra metric sent with a reading, e.g. battery',
+  `value` double NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `node_metric` (`node_id`,`metric`,`timestamp`),
+  KEY `timestamp` (`timestamp`)
+) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `readings_minute`
+--
+
+CREATE TABLE IF NOT EXISTS `readings_minute` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `node_id` int(11) NOT NULL,
+  `temp_min` float DEFAULT NULL,
+  `temp_max` float DEFAULT NULL,
+  `temp_mean` float DEFAULT NULL,
+  `temp_count` int(11) NOT NULL DEFAULT '0',
+  `pressure_min` float DEFAULT NULL,
+  `pressure_max` float DEFAULT NULL,
+  `pressure_mean` float DEFAULT NULL,
+  `pressure_count` int(11) NOT NULL DEFAULT '0',
+  `humidity_min` float DEFAULT NULL,
+  `humidity_max` float DEFAULT NULL,
+  `humidity_mean` float DEFAULT NULL,
+  `humidity_count` int(11) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `bucket` (`node_id`,`timestamp`),
+  KEY `timestamp` (`timestamp`)
+) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `readings_hourly`
+--
+
+CREATE TABLE IF NOT EXISTS `readings_hourly` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `node_id` int(11) NOT NULL,
+  `temp_min` float DEFAULT NULL,
+  `temp_max` float DEFAULT NULL,
+  `temp_mean` float DEFAULT NULL,
+  `temp_count` int(11) NOT NULL DEFAULT '0',
+  `pressure_min` float DEFAULT NULL,
+  `pressure_max` float DEFAULT NULL,
+  `pressure_mean` float DEFAULT NULL,
+  `pressure_count` int(11) NOT NULL DEFAULT '0',
+  `humidity_min` float DEFAULT NULL,
+  `humidity_max` float DEFAULT NULL,
+  `humidity_mean` float DEFAULT NULL,
+  `humidity_count` int(11) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `bucket` (`node_id`,`timestamp`),
+  KEY `timestamp` (`timestamp`)
+) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `readings_daily`
+--
+
+CREATE TABLE IF NOT EXISTS `readings_daily` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `node_id` int(11) NOT NULL,
+  `temp_min` float DEFAULT NULL,
+  `temp_max` float DEFAULT NULL,
+  `temp_mean` float DEFAULT NULL,
+  `temp_count` int(11) NOT NULL DEFAULT '0',
+  `pressure_min` float DEFAULT NULL,
+  `pressure_max` float DEFAULT NULL,
+  `pressure_mean` float DEFAULT NULL,
+  `pressure_count` int(11) NOT NULL DEFAULT '0',
+  `humidity_min` float DEFAULT NULL,
+  `humidity_max` float DEFAULT NULL,
+  `humidity_mean` float DEFAULT NULL,
+  `humidity_count` int(11) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `bucket` (`node_id`,`timestamp`),
+  KEY `timestamp` (`timestamp`)
+) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
+
+-- --------------------------------------------------------
+
 --
 -- Table structure for table `settings`
 --
@@ -77,6 +242,93 @@ CREATE TABLE IF NOT EXISTS `settings` (
   UNIQUE KEY `key` (`key`)
 ) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
 
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `settings_history`
+--
+
+CREATE TABLE IF NOT EXISTS `settings_history` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `key` varchar(128) NOT NULL,
+  `old_value` varchar(128) DEFAULT NULL,
+  `new_value` varchar(128) NOT NULL,
+  `actor` varchar(256) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `key` (`key`)
+) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `unknown_devices`
+--
+
+CREATE TABLE IF NOT EXISTS `unknown_devices` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `mac` char(17) NOT NULL,
+  `hostname` varchar(256) DEFAULT NULL,
+  `first_seen` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `last_seen` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  `ignored` tinyint(4) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `mac` (`mac`)
+) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `users`
+--
+-- Add the first user with: ernest-server -add-user NAME -control
+--
+
+CREATE TABLE IF NOT EXISTS `users` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `username` varchar(128) NOT NULL,
+  `password_hash` varchar(256) NOT NULL,
+  `can_control` tinyint(4) NOT NULL DEFAULT '0' COMMENT 'Can change settings and turn on the heat, rather than just look',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `username` (`username`)
+) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `sessions`
+--
+
+CREATE TABLE IF NOT EXISTS `sessions` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `token_hash` char(64) NOT NULL COMMENT 'SHA-256 of the session cookie',
+  `user` int(11) NOT NULL,
+  `csrf_token` char(64) NOT NULL,
+  `created` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `expires` timestamp NOT NULL DEFAULT '0000-00-00 00:00:00',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash` (`token_hash`),
+  KEY `user` (`user`)
+) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `api_tokens`
+--
+
+CREATE TABLE IF NOT EXISTS `api_tokens` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user` int(11) NOT NULL,
+  `name` varchar(128) NOT NULL,
+  `token_hash` char(64) NOT NULL COMMENT 'SHA-256 of the token',
+  `created` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `last_used` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash` (`token_hash`),
+  KEY `user` (`user`)
+) ENGINE=InnoDB  DEFAULT CHARSET=latin1 AUTO_INCREMENT=1 ;
+
 /*!40101 SET CHARACTER_SET_CLIENT=@OLD_CHARACTER_SET_CLIENT */;
 /*!40101 SET CHARACTER_SET_RESULTS=@OLD_CHARACTER_SET_RESULTS */;
 /*!40101 SET COLLATION_CONNECTION=@OLD_COLLATION_CONNECTION */;
@@ -0,0 +1,277 @@
+/*
+Housemate management
+
+Adds, edits and removes people and their devices. Changes take effect
+straight away: housemates are reloaded from the database by the presence loop,
+carrying over everybody's presence state. Removing somebody leaves their
+people_history and presence_events in place.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+var errNoDeviceAddress = errors.New("A device needs a MAC address, hostname or client identifier")
+var errBadMac = errors.New("That doesn't look like a MAC address")
+var errNoSuchPerson = errors.New("No such person")
+var errNoSuchDevice = errors.New("No such device")
+
+type PersonFields struct {
+	Name        string
+	AwayTimeout sql.NullInt64
+	Debounce    sql.NullInt64
+}
+
+type DeviceFields struct {
+	Label             string
+	Mac               string
+	Hostname          string
+	ClientId          string
+	CountsForPresence bool
+}
+
+func (p *PersonFields) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return errNameRequired
+	}
+	if p.AwayTimeout.Valid && p.AwayTimeout.Int64 <= 0 {
+		return errors.New("Away timeout must be positive")
+	}
+	if p.Debounce.Valid && p.Debounce.Int64 < 0 {
+		return errors.New("Debounce can't be negative")
+	}
+	return nil
+}
+
+func (d *DeviceFields) validate() error {
+	d.Hostname = strings.TrimSpace(d.Hostname)
+	d.ClientId = normaliseClientId(d.ClientId)
+	d.Label = strings.TrimSpace(d.Label)
+	if mac := strings.TrimSpace(d.Mac); mac != "" {
+		d.Mac = normaliseMac(mac)
+		if d.Mac == "" {
+			return errBadMac
+		}
+	}
+	if d.Mac == "" && d.Hostname == "" && d.ClientId == "" {
+		return errNoDeviceAddress
+	}
+	if d.Label == "" {
+		d.Label = d.Hostname
+	}
+	if d.Label == "" {
+		d.Label = d.Mac
+	}
+	if d.Label == "" {
+		d.Label = d.ClientId
+	}
+	return nil
+}
+
+// Apply the result of an UPDATE or DELETE, complaining if nothing matched
+func checkAffected(res sql.Result, err error, missing error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return missing
+	}
+	return nil
+}
+
+func (t *DhcpStatus) CreatePerson(p *PersonFields) (int64, error) {
+	if err := p.validate(); err != nil {
+		return 0, err
+	}
+	res, err := t.db.Exec(`INSERT INTO nest.people (name, away_timeout, debounce)
+		VALUES (?, ?, ?)`, p.Name, p.AwayTimeout, p.Debounce)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return id, t.Reload()
+}
+
+func (t *DhcpStatus) UpdatePerson(id int64, p *PersonFields) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	// MySQL reports no rows affected if nothing changed, so check existence
+	// separately
+	if !t.personExists(id) {
+		return errNoSuchPerson
+	}
+	_, err := t.db.Exec(`UPDATE nest.people
+		SET name = ?, away_timeout = ?, debounce = ? WHERE id = ?`,
+		p.Name, p.AwayTimeout, p.Debounce, id)
+	if err != nil {
+		return err
+	}
+	return t.Reload()
+}
+
+func (t *DhcpStatus) personExists(id int64) bool {
+	var found int64
+	err := t.db.QueryRow(`SELECT id FROM nest.people WHERE id = ?`, id).Scan(&found)
+	return err == nil
+}
+
+func (t *DhcpStatus) DeletePerson(id int64) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM nest.devices WHERE person = ?`, id); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM nest.people WHERE id = ?`, id)
+	if err := checkAffected(res, err, errNoSuchPerson); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return t.Reload()
+}
+
+// Give somebody a new random presence token, returning it
+func (t *DhcpStatus) ResetPresenceToken(id int64) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	res, err := t.db.Exec(`UPDATE nest.people SET presence_token = ? WHERE id = ?`, token, id)
+	if err := checkAffected(res, err, errNoSuchPerson); err != nil {
+		return "", err
+	}
+	return token, t.Reload()
+}
+
+func (t *DhcpStatus) CreateDevice(person_id int64, d *DeviceFields) (int64, error) {
+	if err := d.validate(); err != nil {
+		return 0, err
+	}
+	if !t.personExists(person_id) {
+		return 0, errNoSuchPerson
+	}
+	res, err := t.db.Exec(`INSERT INTO nest.devices
+		(person, label, mac, hostname, client_id, counts_for_presence)
+		VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?)`,
+		person_id, d.Label, d.Mac, d.Hostname, d.ClientId, d.CountsForPresence)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return id, t.Reload()
+}
+
+func (t *DhcpStatus) UpdateDevice(id int64, d *DeviceFields) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+	var found int64
+	if err := t.db.QueryRow(`SELECT id FROM nest.devices WHERE id = ?`, id).Scan(&found); err != nil {
+		if err == sql.ErrNoRows {
+			return errNoSuchDevice
+		}
+		return err
+	}
+	_, err := t.db.Exec(`UPDATE nest.devices
+		SET label = ?, mac = NULLIF(?, ''), hostname = NULLIF(?, ''),
+		client_id = NULLIF(?, ''), counts_for_presence = ?
+		WHERE id = ?`,
+		d.Label, d.Mac, d.Hostname, d.ClientId, d.CountsForPresence, id)
+	if err != nil {
+		return err
+	}
+	return t.Reload()
+}
+
+func (t *DhcpStatus) DeleteDevice(id int64) error {
+	res, err := t.db.Exec(`DELETE FROM nest.devices WHERE id = ?`, id)
+	if err := checkAffected(res, err, errNoSuchDevice); err != nil {
+		return err
+	}
+	return t.Reload()
+}
+
+// Ask the presence loop to reload housemates, waiting until it has
+func (t *DhcpStatus) Reload() error {
+	done := make(chan error, 1)
+	t.reloads <- done
+	return <-done
+}
+
+// Replace the housemates with a fresh copy from the database, keeping the
+// presence state of everybody and every device that's still around. Must be
+// called from the presence loop.
+func (t *DhcpStatus) reloadHousemates() error {
+	housemates, err := t.loadHousemates()
+	if err != nil {
+		return err
+	}
+
+	previous := make(map[int64]*Housemate)
+	for _, h := range t.housemates {
+		previous[h.Id] = h
+	}
+
+	for _, h := range housemates {
+		prev, ok := previous[h.Id]
+		if !ok {
+			continue
+		}
+		h.Home = prev.Home
+		h.StateChanged = prev.StateChanged
+		h.Pinned = prev.Pinned
+		h.pinned_until = prev.pinned_until
+		h.LeftAt = prev.LeftAt
+		h.NearUntil = prev.NearUntil
+		h.pin_source = prev.pin_source
+		h.skip_debounce = prev.skip_debounce
+
+		prev_devices := make(map[int64]*Device)
+		for _, d := range prev.Devices {
+			prev_devices[d.Id] = d
+		}
+		for _, d := range h.Devices {
+			if pd, ok := prev_devices[d.Id]; ok {
+				h.sawDevice(d, pd.Last_seen, pd.Source)
+				if pd.persisted.After(d.persisted) {
+					d.persisted = pd.persisted
+				}
+			}
+		}
+		// Explicit reports move Last_seen without a device
+		if prev.Last_seen.After(h.Last_seen) {
+			h.Last_seen = prev.Last_seen
+		}
+	}
+
+	t.housemates = housemates
+	// Publish straight away, so the caller sees their change as soon as
+	// Reload returns
+	t.publishSnapshot(time.Now())
+	return nil
+}
@@ -19,9 +19,9 @@ func generateHumidityPlot(d *Decider, outfile string) error {
 	p.X.Label.Text = "Date"
 	p.Y.Label.Text = "Humidity (RH)"
 	p.Add(plotter.NewGrid())
-	p.X.Tick.Marker = dateTicks
+	p.X.Tick.Marker = dateTicker(d.config.DisplayLocation())
 
-	for node_id, node_data := range d.getReadingHistory() {
+	for node_id, node_data := range d.getReadingHistory(HISTORY_PERIOD) {
 		node_plot_options := d.getNodePlotOpts(node_id)
 		l, err := plotter.NewLine(humidityDataSeries(node_data))
 		if err != nil {
@@ -53,9 +53,9 @@ func generatePressurePlot(d *Decider, outfile string) error {
 	p.X.Label.Text = "Date"
 	p.Y.Label.Text = "Pressure (mBar)"
 	p.Add(plotter.NewGrid())
-	p.X.Tick.Marker = dateTicks
+	p.X.Tick.Marker = dateTicker(d.config.DisplayLocation())
 
-	for node_id, node_data := range d.getReadingHistory() {
+	for node_id, node_data := range d.getReadingHistory(HISTORY_PERIOD) {
 		node_plot_options := d.getNodePlotOpts(node_id)
 		l, err := plotter.NewLine(pressureDataSeries(node_data))
 		if err != nil {
@@ -78,7 +78,7 @@ func generatePressurePlot(d *Decider, outfile string) error {
 	return nil
 }
 
-func generateTempPlot(d *Decider, farenheit bool, outfile string) error {
+func generateTempPlot(d *Decider, fahrenheit bool, outfile string) error {
 	p, err := plot.New()
 	if err != nil {
 		return err
@@ -88,12 +88,12 @@ func generateTempPlot(d *Decider, farenheit bool, outfile string) error {
 	p.X.Label.Text = "Date"
 	p.Y.Label.Text = "Temperature"
 	p.Add(plotter.NewGrid())
-	p.X.Tick.Marker = dateTicks
+	p.X.Tick.Marker = dateTicker(d.config.DisplayLocation())
 	p.Y.Tick.Marker = tempTicks
 
-	for node_id, node_data := range d.getReadingHistory() {
+	for node_id, node_data := range d.getReadingHistory(HISTORY_PERIOD) {
 		node_plot_options := d.getNodePlotOpts(node_id)
-		l, err := plotter.NewLine(tempDataSeries(node_data, farenheit))
+		l, err := plotter.NewLine(tempDataSeries(node_data, fahrenheit))
 		if err != nil {
 			return err
 		}
@@ -126,13 +126,15 @@ func tempTicks(min, max float64) []plot.Tick {
 	return tks
 }
 
-func dateTicks(min, max float64) []plot.Tick {
-	tks := plot.DefaultTicks(min, max)
-	for i, t := range tks {
-		timestamp := time.Unix(int64(t.Value), 0)
-		tks[i].Label = fmt.Sprintf("%s", timestamp)
+func dateTicker(loc *time.Location) func(min, max float64) []plot.Tick {
+	return func(min, max float64) []plot.Tick {
+		tks := plot.DefaultTicks(min, max)
+		for i, t := range tks {
+			timestamp := time.Unix(int64(t.Value), 0).In(loc)
+			tks[i].Label = timestamp.Format("Jan 2 15:04")
+		}
+		return tks
 	}
-	return tks
 }
 
 func humidityDataSeries(node_data []*ReadingData) plotter.XYs {
@@ -164,3 +166,49 @@ func tempDataSeries(node_data []*ReadingData, f bool) plotter.XYs {
 	}
 	return pts
 }
+
+// Bar colours for each housemate in turn
+var PERSON_COLORS = []color.RGBA{
+	{R: 31, G: 119, B: 180, A: 255},
+	{R: 255, G: 127, B: 14, A: 255},
+	{R: 44, G: 160, B: 44, A: 255},
+	{R: 214, G: 39, B: 40, A: 255},
+	{R: 148, G: 103, B: 189, A: 255},
+	{R: 140, G: 86, B: 75, A: 255},
+}
+
+// Average hours each person spends at home on each day of the week
+func generatePresencePlot(analytics []*PresenceAnalytics, outfile string) error {
+	p, err := plot.New()
+	if err != nil {
+		return err
+	}
+
+	p.Title.Text = "Hours At Home"
+	p.X.Label.Text = "Day"
+	p.Y.Label.Text = "Hours"
+	p.Y.Min = 0
+	p.Y.Max = 24
+	p.Add(plotter.NewGrid())
+
+	bar_width := vg.Points(10)
+	for i, a := range analytics {
+		bars, err := plotter.NewBarChart(plotter.Values(a.WeekdayHours), bar_width)
+		if err != nil {
+			return err
+		}
+		bars.Color = PERSON_COLORS[i%len(PERSON_COLORS)]
+		bars.LineStyle.Width = vg.Points(0)
+		// Group each day's bars around the day's label
+		bars.Offset = vg.Length(float64(i)-float64(len(analytics)-1)/2) * bar_width
+		p.Add(bars)
+		p.Legend.Add(a.Name, bars)
+	}
+	p.Legend.Top = true
+	p.NominalX("Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat")
+
+	if err := p.Save(15, 10, outfile); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+/*
+Presence state machine
+
+Turns device sightings into explicit arrive and leave transitions for each
+housemate. Each person has their own away timeout, and a debounce period that
+stops them flapping between states. Transitions are stored in the
+presence_events table and sent to any subscribers as they happen.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+const PRESENCE_EVENT_ARRIVE = "arrive"
+const PRESENCE_EVENT_LEAVE = "leave"
+const PRESENCE_EVENT_NEAR = "near"
+
+// Unknown devices appearing and going quiet. These have no person, and aren't
+// stored in presence_events.
+const PRESENCE_EVENT_GUESTS_ARRIVE = "guests_arrive"
+const PRESENCE_EVENT_GUESTS_LEAVE = "guests_leave"
+const PRESENCE_GUESTS_NAME = "Guests"
+
+const PRESENCE_DEFAULT_AWAY_TIMEOUT = 10 * time.Minute
+
+// An explicit arrival stops counting this long after it was reported, so a
+// missed departure can't keep the house heated forever
+const PRESENCE_PIN_TIMEOUT = 12 * time.Hour
+
+// How often to check whether anybody has timed out
+const PRESENCE_CHECK_INTERVAL = 15 * time.Second
+
+// Events waiting for a slow subscriber before they start being dropped
+const PRESENCE_SUBSCRIBER_BUFFER = 16
+
+type PresenceEvent struct {
+	PersonId int64
+	Name     string
+	Type     string
+	Time     time.Time
+	// Label of the device that triggered an arrival
+	Device string
+}
+
+// Explicit presence report, such as from a phone's geofence
+type PresenceReport struct {
+	PersonId int64
+	Type     string
+	Time     time.Time
+	Source   string
+}
+
+// Whether this housemate should be considered home right now. An explicit
+// arrival keeps them home until an explicit departure or the pin runs out,
+// and an explicit departure overrides any earlier sightings.
+func (h *Housemate) presentAt(now time.Time) bool {
+	if h.isPinned(now) {
+		return true
+	}
+	return now.Sub(h.Last_seen) < h.AwayTimeout && h.Last_seen.After(h.LeftAt)
+}
+
+func (h *Housemate) isPinned(now time.Time) bool {
+	return h.Pinned && now.Before(h.pinned_until)
+}
+
+func (h *Housemate) isNear(now time.Time) bool {
+	return !h.Home && now.Before(h.NearUntil)
+}
+
+// The transition this housemate is due, if any
+func (h *Housemate) pendingEvent(now time.Time) string {
+	seen_recently := h.presentAt(now)
+	if seen_recently == h.Home {
+		return ""
+	}
+	if now.Sub(h.StateChanged) < h.Debounce && !h.skip_debounce {
+		return ""
+	}
+	h.skip_debounce = false
+	if seen_recently {
+		return PRESENCE_EVENT_ARRIVE
+	}
+	return PRESENCE_EVENT_LEAVE
+}
+
+// Move anybody due a transition into their new state
+func (t *DhcpStatus) updatePresence(now time.Time) {
+	for _, housemate := range t.housemates {
+		event_type := housemate.pendingEvent(now)
+		if event_type == "" {
+			continue
+		}
+
+		housemate.Home = event_type == PRESENCE_EVENT_ARRIVE
+		housemate.StateChanged = now
+
+		event := new(PresenceEvent)
+		event.PersonId = housemate.Id
+		event.Name = housemate.Name
+		event.Type = event_type
+		event.Time = now
+		if housemate.Home && housemate.isPinned(now) {
+			event.Device = housemate.pin_source
+		} else if housemate.Home && housemate.LastDevice != nil {
+			event.Device = housemate.LastDevice.Label
+		}
+		if housemate.Home {
+			housemate.NearUntil = time.Time{}
+		}
+		log.Println(event.Name, event.Type)
+
+		t.recordEvent(event)
+		t.publish(event)
+	}
+
+	// Guests come and go too, which matters in guest mode
+	guests_home := t.GuestsHome()
+	if guests_home != t.guests_home {
+		t.guests_home = guests_home
+		event := new(PresenceEvent)
+		event.Name = PRESENCE_GUESTS_NAME
+		event.Type = PRESENCE_EVENT_GUESTS_LEAVE
+		if guests_home {
+			event.Type = PRESENCE_EVENT_GUESTS_ARRIVE
+		}
+		event.Time = now
+		log.Println(event.Name, event.Type)
+		t.publish(event)
+	}
+}
+
+// Restore whether somebody was home from their last recorded transition. If
+// they have come or gone since, the next presence update will notice.
+func (t *DhcpStatus) loadPresenceState(h *Housemate) error {
+	row := t.db.QueryRow(`SELECT event, timestamp FROM nest.presence_events
+		WHERE person = ? AND event IN ('arrive', 'leave')
+		ORDER BY timestamp DESC, id DESC LIMIT 1`, h.Id)
+	var event_type string
+	var timestamp time.Time
+	err := row.Scan(&event_type, &timestamp)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h.Home = event_type == PRESENCE_EVENT_ARRIVE
+	h.StateChanged = timestamp
+	return nil
+}
+
+// Save device sightings, so that presence survives a restart
+func (t *DhcpStatus) persistPresence() {
+	for _, housemate := range t.housemates {
+		for _, device := range housemate.Devices {
+			if !device.Last_seen.After(device.persisted) {
+				continue
+			}
+			_, err := t.db.Exec(`UPDATE nest.devices
+				SET last_seen = ?, last_seen_source = ?
+				WHERE id = ?`,
+				device.Last_seen.UTC(), device.Source, device.Id,
+			)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			device.persisted = device.Last_seen
+		}
+	}
+}
+
+// Keep an explicit arrival, or its end, across restarts
+func (t *DhcpStatus) persistPin(h *Housemate) {
+	var pinned_until sql.NullTime
+	if h.Pinned {
+		pinned_until = sql.NullTime{Time: h.pinned_until.UTC(), Valid: true}
+	}
+	_, err := t.db.Exec(`UPDATE nest.people
+		SET pinned_until = ?, pin_source = NULLIF(?, '')
+		WHERE id = ?`,
+		pinned_until, h.pin_source, h.Id,
+	)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// How far back to look for sightings on startup. Anything older than the
+// longest away timeout can't make somebody home.
+func (t *DhcpStatus) backfillSince(now time.Time) time.Time {
+	longest := PRESENCE_DEFAULT_AWAY_TIMEOUT
+	for _, housemate := range t.housemates {
+		if housemate.AwayTimeout > longest {
+			longest = housemate.AwayTimeout
+		}
+	}
+	return now.Add(-longest)
+}
+
+// Queue an explicit report to be applied by the presence loop. Times come
+// from the client, so one in the future is taken as now; otherwise it would
+// keep somebody home until then.
+func (t *DhcpStatus) Report(report *PresenceReport) {
+	if now := time.Now(); report.Time.After(now) {
+		report.Time = now
+	}
+	t.reports <- report
+}
+
+func (t *DhcpStatus) applyReport(report *PresenceReport) {
+	var housemate *Housemate
+	for _, h := range t.housemates {
+		if h.Id == report.PersonId {
+			housemate = h
+		}
+	}
+	if housemate == nil {
+		return
+	}
+
+	switch report.Type {
+	case PRESENCE_EVENT_ARRIVE:
+		housemate.Pinned = true
+		housemate.pinned_until = report.Time.Add(PRESENCE_PIN_TIMEOUT)
+		housemate.pin_source = report.Source
+		housemate.skip_debounce = true
+		if report.Time.After(housemate.Last_seen) {
+			housemate.Last_seen = report.Time
+		}
+		t.persistPin(housemate)
+	case PRESENCE_EVENT_LEAVE:
+		housemate.Pinned = false
+		housemate.pinned_until = time.Time{}
+		t.persistPin(housemate)
+		housemate.LeftAt = report.Time
+		housemate.NearUntil = time.Time{}
+		housemate.skip_debounce = true
+	case PRESENCE_EVENT_NEAR:
+		if housemate.Home || housemate.isNear(report.Time) {
+			housemate.NearUntil = report.Time.Add(housemate.AwayTimeout)
+			return
+		}
+		housemate.NearUntil = report.Time.Add(housemate.AwayTimeout)
+
+		event := new(PresenceEvent)
+		event.PersonId = housemate.Id
+		event.Name = housemate.Name
+		event.Type = PRESENCE_EVENT_NEAR
+		event.Time = report.Time
+		event.Device = report.Source
+		log.Println(event.Name, event.Type)
+
+		t.recordEvent(event)
+		t.publish(event)
+	}
+}
+
+func (t *DhcpStatus) AnybodyNear() bool {
+	return t.Snapshot().AnybodyNear(time.Now())
+}
+
+func (t *DhcpStatus) recordEvent(event *PresenceEvent) {
+	_, err := t.db.Exec(`INSERT INTO nest.presence_events
+		(timestamp, person, event, device)
+		VALUES
+		(?, ?, ?, NULLIF(?, ''))`,
+		event.Time.UTC(), event.PersonId, event.Type, event.Device,
+	)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Get a channel that receives every presence transition. Subscribers that
+// fall behind miss events rather than holding up presence detection.
+func (t *DhcpStatus) Subscribe() <-chan *PresenceEvent {
+	t.subscribers_mutex.Lock()
+	defer t.subscribers_mutex.Unlock()
+	ch := make(chan *PresenceEvent, PRESENCE_SUBSCRIBER_BUFFER)
+	t.subscribers = append(t.subscribers, ch)
+	return ch
+}
+
+// Queue an event to be sent once the snapshot reflects it, so subscribers
+// looking at the snapshot see the change they're being told about
+func (t *DhcpStatus) publish(event *PresenceEvent) {
+	t.pending_events = append(t.pending_events, event)
+}
+
+func (t *DhcpStatus) flushEvents() {
+	t.subscribers_mutex.Lock()
+	defer t.subscribers_mutex.Unlock()
+	for _, event := range t.pending_events {
+		for _, ch := range t.subscribers {
+			select {
+			case ch <- event:
+			default:
+				log.Println("Presence subscriber is full, dropping event")
+			}
+		}
+	}
+	t.pending_events = nil
+}
@@ -0,0 +1,212 @@
+/*
+Presence analytics
+
+Summarises each housemate's comings and goings: their typical arrival and
+departure times from presence_events, and how many hours a day they spend at
+home, overall and by day of the week, from people_history. Days are split in
+the display timezone.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"time"
+)
+
+const ANALYTICS_DEFAULT_PERIOD = 28 * 24 * time.Hour
+const ANALYTICS_MAX_PERIOD = 366 * 24 * time.Hour
+const MINUTES_PER_DAY = 24 * 60
+
+type DailyHours struct {
+	Date  string  `json:"date"`
+	Hours float64 `json:"hours"`
+}
+
+type PresenceAnalytics struct {
+	PersonId int64     `json:"person_id"`
+	Name     string    `json:"name"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+	// Median time of day, as "15:04", or empty if they never did
+	TypicalArrival     string  `json:"typical_arrival,omitempty"`
+	TypicalDeparture   string  `json:"typical_departure,omitempty"`
+	Arrivals           int     `json:"arrivals"`
+	Departures         int     `json:"departures"`
+	AverageHoursPerDay float64 `json:"average_hours_per_day"`
+	// Average hours at home on each day of the week, Sunday first
+	WeekdayHours []float64     `json:"weekday_hours"`
+	DailyHours   []*DailyHours `json:"daily_hours"`
+}
+
+// Median time of day of the given times, in the given timezone. The day is
+// cut at the widest gap between times rather than at midnight, so times
+// either side of midnight such as 23:50 and 00:10 give 00:00, not 12:00.
+func typicalTimeOfDay(times []time.Time, loc *time.Location) string {
+	if len(times) == 0 {
+		return ""
+	}
+	minutes := make([]int, 0, len(times))
+	for _, t := range times {
+		local := t.In(loc)
+		minutes = append(minutes, local.Hour()*60+local.Minute())
+	}
+	sort.Ints(minutes)
+
+	// The gap that wraps around midnight counts too
+	cut := 0
+	widest := minutes[0] + MINUTES_PER_DAY - minutes[len(minutes)-1]
+	for i := 1; i < len(minutes); i++ {
+		if gap := minutes[i] - minutes[i-1]; gap > widest {
+			widest = gap
+			cut = i
+		}
+	}
+	unwrapped := make([]int, 0, len(minutes))
+	for i := range minutes {
+		m := minutes[(cut+i)%len(minutes)]
+		if cut+i >= len(minutes) {
+			m += MINUTES_PER_DAY
+		}
+		unwrapped = append(unwrapped, m)
+	}
+
+	median := unwrapped[len(unwrapped)/2]
+	if len(unwrapped)%2 == 0 {
+		median = (unwrapped[len(unwrapped)/2-1] + median) / 2
+	}
+	median %= MINUTES_PER_DAY
+	return time.Date(2000, 1, 1, median/60, median%60, 0, 0, loc).Format("15:04")
+}
+
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	local := t.In(loc)
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+}
+
+// Add a period at home to the per day totals, splitting it at midnight
+func addHomeHours(hours map[string]float64, start, end time.Time, loc *time.Location) {
+	for start.Before(end) {
+		day := startOfDay(start, loc)
+		segment_end := day.AddDate(0, 0, 1)
+		if end.Before(segment_end) {
+			segment_end = end
+		}
+		hours[day.Format("2006-01-02")] += segment_end.Sub(start).Hours()
+		start = segment_end
+	}
+}
+
+func (d *Decider) getPresenceAnalytics(person *Housemate, period time.Duration) (*PresenceAnalytics, error) {
+	loc := d.config.DisplayLocation()
+	a := new(PresenceAnalytics)
+	a.PersonId = person.Id
+	a.Name = person.Name
+	a.Until = time.Now()
+	a.Since = startOfDay(a.Until.Add(-period), loc)
+
+	// Arrival and departure times
+	rows, err := d.db.Query(`SELECT event, timestamp FROM nest.presence_events
+		WHERE person = ? AND event IN ('arrive', 'leave') AND timestamp >= ?
+		ORDER BY timestamp, id`, person.Id, a.Since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	var arrivals, departures []time.Time
+	for rows.Next() {
+		var event_type string
+		var timestamp time.Time
+		if err := rows.Scan(&event_type, &timestamp); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if event_type == PRESENCE_EVENT_ARRIVE {
+			arrivals = append(arrivals, timestamp)
+		} else {
+			departures = append(departures, timestamp)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	a.Arrivals = len(arrivals)
+	a.Departures = len(departures)
+	a.TypicalArrival = typicalTimeOfDay(arrivals, loc)
+	a.TypicalDeparture = typicalTimeOfDay(departures, loc)
+
+	// Time at home, starting from whatever state they were in beforehand
+	var home bool
+	err = d.db.QueryRow(`SELECT is_home FROM nest.people_history
+		WHERE person = ? AND timestamp < ?
+		ORDER BY timestamp DESC, id DESC LIMIT 1`, person.Id, a.Since.UTC()).Scan(&home)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	rows, err = d.db.Query(`SELECT timestamp, is_home FROM nest.people_history
+		WHERE person = ? AND timestamp >= ?
+		ORDER BY timestamp, id`, person.Id, a.Since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hours := make(map[string]float64)
+	cursor := a.Since
+	for rows.Next() {
+		var timestamp time.Time
+		var is_home bool
+		if err := rows.Scan(&timestamp, &is_home); err != nil {
+			return nil, err
+		}
+		if home {
+			addHomeHours(hours, cursor, timestamp, loc)
+		}
+		home = is_home
+		cursor = timestamp
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if home {
+		addHomeHours(hours, cursor, a.Until, loc)
+	}
+
+	// Fill in every day of the period, including those spent away
+	a.WeekdayHours = make([]float64, 7)
+	weekday_count := make([]int, 7)
+	total := 0.0
+	for day := a.Since; day.Before(a.Until); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		a.DailyHours = append(a.DailyHours, &DailyHours{date, hours[date]})
+		a.WeekdayHours[day.Weekday()] += hours[date]
+		weekday_count[day.Weekday()]++
+		total += hours[date]
+	}
+	for i := range a.WeekdayHours {
+		if weekday_count[i] > 0 {
+			a.WeekdayHours[i] /= float64(weekday_count[i])
+		}
+	}
+	if len(a.DailyHours) > 0 {
+		a.AverageHoursPerDay = total / float64(len(a.DailyHours))
+	}
+	return a, nil
+}
+
+// Analytics for everybody, skipping anyone whose history can't be read
+func (d *Decider) getAllPresenceAnalytics(period time.Duration) []*PresenceAnalytics {
+	all := make([]*PresenceAnalytics, 0)
+	for _, person := range d.dhcp_tailer.Snapshot().People {
+		a, err := d.getPresenceAnalytics(person, period)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		all = append(all, a)
+	}
+	return all
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypicalTimeOfDay(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2016, time.January, 3, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name  string
+		times []time.Time
+		want  string
+	}{
+		{"none", nil, ""},
+		{"one", []time.Time{at(12, 0)}, "12:00"},
+		{"odd count", []time.Time{at(8, 0), at(9, 0), at(10, 0)}, "09:00"},
+		{"even count", []time.Time{at(7, 0), at(7, 30)}, "07:15"},
+		{"either side of midnight", []time.Time{at(23, 50), at(0, 10)}, "00:00"},
+		{"mostly after midnight", []time.Time{at(23, 50), at(0, 10), at(0, 20)}, "00:10"},
+		{"mostly before midnight", []time.Time{at(22, 0), at(23, 0), at(1, 0)}, "23:00"},
+		{"late evening", []time.Time{at(23, 30), at(23, 40)}, "23:35"},
+	}
+	for _, test := range tests {
+		if got := typicalTimeOfDay(test.times, time.UTC); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// Times are taken in the display timezone
+	loc := time.FixedZone("EST", -5*60*60)
+	if got := typicalTimeOfDay([]time.Time{at(4, 50), at(5, 10)}, loc); got != "00:00" {
+		t.Errorf("in EST: got %q, want %q", got, "00:00")
+	}
+}
+
+func TestAddHomeHours(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(month time.Month, day, hour int) time.Time {
+		return time.Date(2016, month, day, hour, 0, 0, 0, loc)
+	}
+
+	tests := []struct {
+		name  string
+		start time.Time
+		end   time.Time
+		want  map[string]float64
+	}{
+		{"within a day", at(time.January, 3, 9), at(time.January, 3, 17),
+			map[string]float64{"2016-01-03": 8}},
+		{"over midnight", at(time.January, 3, 22), at(time.January, 4, 6),
+			map[string]float64{"2016-01-03": 2, "2016-01-04": 6}},
+		{"several days", at(time.January, 3, 12), at(time.January, 5, 12),
+			map[string]float64{"2016-01-03": 12, "2016-01-04": 24, "2016-01-05": 12}},
+		{"clocks go forward", at(time.March, 12, 22), at(time.March, 13, 12),
+			map[string]float64{"2016-03-12": 2, "2016-03-13": 11}},
+		{"clocks go back", at(time.November, 6, 0), at(time.November, 7, 0),
+			map[string]float64{"2016-11-06": 25}},
+		{"empty", at(time.January, 3, 9), at(time.January, 3, 9), map[string]float64{}},
+		{"backwards", at(time.January, 3, 17), at(time.January, 3, 9), map[string]float64{}},
+	}
+	for _, test := range tests {
+		hours := make(map[string]float64)
+		addHomeHours(hours, test.start, test.end, loc)
+		if len(hours) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, hours, test.want)
+			continue
+		}
+		for day, want := range test.want {
+			if hours[day] != want {
+				t.Errorf("%s: got %v, want %v", test.name, hours, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Presence reporting API
+
+Lets a housemate's phone or home automation report that they have arrived,
+left, or are nearly home. Requests are authenticated with the person's
+presence token, sent either as a bearer token, as the password of HTTP basic
+auth, or as a token value in a POST body, but never in the URL. OwnTracks'
+HTTP mode is understood natively.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PRESENCE_DEFAULT_OWNTRACKS_REGION = "home"
+
+// Mean radius of the earth, for working out how far away people are
+const EARTH_RADIUS_METERS = 6371000
+
+type OwnTracksMessage struct {
+	Type      string   `json:"_type"`
+	Event     string   `json:"event"`
+	Desc      string   `json:"desc"`
+	Timestamp int64    `json:"tst"`
+	Lat       float64  `json:"lat"`
+	Lon       float64  `json:"lon"`
+	InRegions []string `json:"inregions"`
+}
+
+// Find whose token was presented with a request
+func (t *WebServer) presencePerson(r *http.Request) *Housemate {
+	// Never from the query string, where it would end up in logs
+	token := r.PostForm.Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	} else if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	if token == "" {
+		return nil
+	}
+
+	for _, housemate := range t.dhcp_tailer.Snapshot().People {
+		if housemate.presence_token != "" &&
+			subtle.ConstantTimeCompare([]byte(housemate.presence_token), []byte(token)) == 1 {
+			return housemate
+		}
+	}
+	return nil
+}
+
+// Handles POSTs to /presence/arrive, /presence/leave, /presence/near and
+// /presence/owntracks
+func (t *WebServer) PresenceApi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	kind := strings.TrimPrefix(r.URL.Path, "/presence/")
+
+	// OwnTracks sends JSON, which mustn't be eaten by ParseForm
+	if kind != "owntracks" {
+		r.ParseForm()
+	}
+
+	person := t.presencePerson(r)
+	if person == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ernest"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch kind {
+	case PRESENCE_EVENT_ARRIVE, PRESENCE_EVENT_LEAVE, PRESENCE_EVENT_NEAR:
+		report := &PresenceReport{
+			PersonId: person.Id,
+			Type:     kind,
+			Time:     time.Now(),
+			Source:   "api",
+		}
+		if ts, err := strconv.ParseInt(r.Form.Get("time"), 10, 64); err == nil {
+			report.Time = time.Unix(ts, 0)
+		}
+		t.dhcp_tailer.Report(report)
+		w.WriteHeader(http.StatusNoContent)
+	case "owntracks":
+		msg := new(OwnTracksMessage)
+		if err := json.NewDecoder(r.Body).Decode(msg); err != nil {
+			http.Error(w, "Bad OwnTracks payload", http.StatusBadRequest)
+			return
+		}
+		for _, report := range t.ownTracksReports(person, msg) {
+			t.dhcp_tailer.Report(report)
+		}
+		// OwnTracks expects a list of messages to pass back to the phone
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Work out what an OwnTracks message says about somebody's presence
+func (t *WebServer) ownTracksReports(person *Housemate, msg *OwnTracksMessage) []*PresenceReport {
+	region := t.config.Presence.OwnTracksRegion
+	if region == "" {
+		region = PRESENCE_DEFAULT_OWNTRACKS_REGION
+	}
+	ts := time.Now()
+	if msg.Timestamp != 0 {
+		ts = time.Unix(msg.Timestamp, 0)
+	}
+	report := func(event_type string) *PresenceReport {
+		return &PresenceReport{
+			PersonId: person.Id,
+			Type:     event_type,
+			Time:     ts,
+			Source:   "owntracks",
+		}
+	}
+
+	reports := make([]*PresenceReport, 0)
+	switch msg.Type {
+	case "transition":
+		if msg.Desc != region {
+			break
+		}
+		if msg.Event == "enter" {
+			reports = append(reports, report(PRESENCE_EVENT_ARRIVE))
+		} else if msg.Event == "leave" {
+			reports = append(reports, report(PRESENCE_EVENT_LEAVE))
+		}
+	case "location":
+		in_region := false
+		for _, r := range msg.InRegions {
+			if r == region {
+				in_region = true
+			}
+		}
+		if in_region {
+			reports = append(reports, report(PRESENCE_EVENT_ARRIVE))
+			break
+		}
+		if person.isPinned(time.Now()) {
+			reports = append(reports, report(PRESENCE_EVENT_LEAVE))
+		}
+		near := float64(t.config.Presence.NearMeters)
+		if near > 0 && distanceMeters(
+			msg.Lat, msg.Lon,
+			t.config.Presence.HomeLatitude, t.config.Presence.HomeLongitude,
+		) < near {
+			reports = append(reports, report(PRESENCE_EVENT_NEAR))
+		}
+	default:
+		log.Println("Ignoring OwnTracks message of type", msg.Type)
+	}
+	return reports
+}
+
+// Great circle distance between two points
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * EARTH_RADIUS_METERS * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,81 @@
+/*
+ARP presence source
+
+Polls the kernel's neighbour table, reporting every device with a complete
+entry as seen.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Set in the flags column of /proc/net/arp once an entry has resolved
+const ATF_COM = 0x02
+
+type ArpSource struct {
+	path          string
+	poll_interval time.Duration
+}
+
+func NewArpSource(path string, poll_interval time.Duration) *ArpSource {
+	t := new(ArpSource)
+	t.path = path
+	t.poll_interval = poll_interval
+	return t
+}
+
+func (t *ArpSource) Name() string {
+	return PRESENCE_SOURCE_ARP
+}
+
+func (t *ArpSource) Run(observations chan<- *PresenceObservation) error {
+	for {
+		macs, err := t.readTable()
+		if err != nil {
+			return err
+		}
+		now := time.Now().Round(time.Second)
+		for _, mac := range macs {
+			observations <- &PresenceObservation{
+				Mac:    mac,
+				Time:   now,
+				Source: t.Name(),
+			}
+		}
+		time.Sleep(t.poll_interval)
+	}
+}
+
+// Lines are "<ip> <hw type> <flags> <mac> <mask> <device>", after a header
+func (t *ArpSource) readTable() ([]string, error) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	macs := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		var flags int
+		if _, err := fmt.Sscanf(fields[2], "0x%x", &flags); err != nil {
+			continue
+		}
+		if flags&ATF_COM == 0 || fields[3] == "00:00:00:00:00:00" {
+			continue
+		}
+		macs = append(macs, fields[3])
+	}
+	return macs, scanner.Err()
+}
@@ -0,0 +1,262 @@
+/*
+Presence history backfill
+
+Rebuilds people_history from old syslog files, including gzipped rotations,
+for periods when the server wasn't running. Every DHCP sighting of a known
+device is replayed through each housemate's away timeout and debounce, and
+the resulting arrivals and departures are written in the same form LogPeople
+uses. Transitions that are already recorded are skipped, so it's safe to run
+more than once.
+
+Run with: ernest-server -backfill-presence [-backfill-logs '/var/log/syslog*']
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const BACKFILL_DEFAULT_LOGS = "/var/log/syslog*"
+
+// Transitions within this long of an existing sample are assumed to have been
+// recorded while the server was running
+const BACKFILL_TOLERANCE = 5 * time.Minute
+
+type PresenceBackfill struct {
+	db         *sql.DB
+	dhcp       *DhcpStatus
+	matcher    *SyslogMatcher
+	housemates []*Housemate
+}
+
+func NewPresenceBackfill(c *Config) *PresenceBackfill {
+	t := new(PresenceBackfill)
+
+	db, err := sql.Open("mysql", c.GetSqlURI())
+	if err != nil {
+		log.Println(err)
+	}
+	t.db = db
+	t.dhcp = NewDhcpStatus(c)
+	t.matcher = NewSyslogMatcher(c.SyslogPrograms(), PRESENCE_SOURCE_SYSLOG)
+
+	return t
+}
+
+// Log files matching the pattern, oldest first: "syslog.7.gz" before
+// "syslog.1" before "syslog"
+func backfillLogFiles(pattern string) ([]string, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	rotation := func(path string) int {
+		parts := strings.Split(strings.TrimSuffix(filepath.Base(path), ".gz"), ".")
+		n, err := strconv.Atoi(parts[len(parts)-1])
+		if err != nil {
+			return 0
+		}
+		return n
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return rotation(paths[i]) > rotation(paths[j])
+	})
+	return paths, nil
+}
+
+func (t *PresenceBackfill) readLog(path string) ([]*PresenceObservation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	observations := make([]*PresenceObservation, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if observation := t.matcher.observe(scanner.Text(), time.Time{}); observation != nil {
+			observation.Mac = normaliseMac(observation.Mac)
+			observation.ClientId = normaliseClientId(observation.ClientId)
+			observations = append(observations, observation)
+		}
+	}
+	return observations, scanner.Err()
+}
+
+// When this housemate next arrives or leaves, given what's been seen so far
+func (h *Housemate) nextTransition() (time.Time, bool) {
+	not_before := h.StateChanged.Add(h.Debounce)
+	if h.Home {
+		leave := h.Last_seen.Add(h.AwayTimeout)
+		if leave.Before(not_before) {
+			leave = not_before
+		}
+		return leave, true
+	}
+	if !h.Last_seen.After(h.StateChanged) {
+		return time.Time{}, false
+	}
+	arrive := h.Last_seen
+	if arrive.Before(not_before) {
+		arrive = not_before
+	}
+	// Debounced for so long that they'd already have gone again
+	if !arrive.Before(h.Last_seen.Add(h.AwayTimeout)) {
+		return time.Time{}, false
+	}
+	return arrive, true
+}
+
+// Run everybody's state machine up to the given time, passing each arrival
+// and departure to record, and returning how many there were
+func (t *PresenceBackfill) advance(until time.Time, record func(*Housemate, time.Time) error) int {
+	transitions := 0
+	for {
+		var next *Housemate
+		var next_time time.Time
+		for _, h := range t.housemates {
+			if at, ok := h.nextTransition(); ok && !at.After(until) && (next == nil || at.Before(next_time)) {
+				next = h
+				next_time = at
+			}
+		}
+		if next == nil {
+			return transitions
+		}
+		next.Home = !next.Home
+		next.StateChanged = next_time
+		if err := record(next, next_time); err != nil {
+			log.Println(err)
+		}
+		transitions++
+	}
+}
+
+// Whether anything was recorded for this housemate around the given time
+func (t *PresenceBackfill) recordedNear(h *Housemate, at time.Time) (bool, error) {
+	var nearby int
+	err := t.db.QueryRow(`SELECT COUNT(*) FROM nest.people_history
+		WHERE person = ? AND timestamp BETWEEN ? AND ?`,
+		h.Id, at.Add(-BACKFILL_TOLERANCE).UTC(), at.Add(BACKFILL_TOLERANCE).UTC(),
+	).Scan(&nearby)
+	return nearby > 0, err
+}
+
+// Write everybody's state at the time of a transition, unless it's already
+// been recorded. Housemates with a sample of their own nearby are left out,
+// so a live sample isn't doubled up.
+func (t *PresenceBackfill) record(changed *Housemate, at time.Time) error {
+	nearby, err := t.recordedNear(changed, at)
+	if err != nil {
+		return err
+	}
+	if nearby {
+		return nil
+	}
+
+	var was_home bool
+	err = t.db.QueryRow(`SELECT is_home FROM nest.people_history
+		WHERE person = ? AND timestamp <= ?
+		ORDER BY timestamp DESC, id DESC LIMIT 1`,
+		changed.Id, at.UTC(),
+	).Scan(&was_home)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && was_home == changed.Home {
+		return nil
+	}
+
+	for _, h := range t.housemates {
+		if h != changed {
+			nearby, err := t.recordedNear(h, at)
+			if err != nil {
+				return err
+			}
+			if nearby {
+				continue
+			}
+		}
+		if err := insertPeopleHistory(t.db, at, h.Id, h.Home); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay every log matching the pattern into people_history
+func (t *PresenceBackfill) Run(pattern string) error {
+	housemates, err := t.dhcp.loadHousemates()
+	if err != nil {
+		return err
+	}
+	// Start from a clean slate, rather than the live presence state
+	for _, h := range housemates {
+		h.Home = false
+		h.StateChanged = time.Time{}
+		h.Last_seen = time.Time{}
+		h.LastDevice = nil
+	}
+	t.housemates = housemates
+
+	paths, err := backfillLogFiles(pattern)
+	if err != nil {
+		return err
+	}
+	observations := make([]*PresenceObservation, 0)
+	for _, path := range paths {
+		found, err := t.readLog(path)
+		if err != nil {
+			log.Println("Skipping", path+":", err)
+			continue
+		}
+		log.Println("Read", len(found), "DHCP messages from", path)
+		observations = append(observations, found...)
+	}
+	if len(observations) == 0 {
+		log.Println("Nothing to backfill")
+		return nil
+	}
+	sort.SliceStable(observations, func(i, j int) bool {
+		return observations[i].Time.Before(observations[j].Time)
+	})
+
+	transitions := 0
+	for _, observation := range observations {
+		transitions += t.advance(observation.Time, t.record)
+		for _, h := range t.housemates {
+			for _, device := range h.Devices {
+				if device.CountsForPresence && device.matches(observation) && observation.Time.After(h.Last_seen) {
+					h.Last_seen = observation.Time
+				}
+			}
+		}
+	}
+	// Don't guess at departures after the logs end
+	transitions += t.advance(observations[len(observations)-1].Time, t.record)
+
+	log.Println("Replayed", transitions, "arrivals and departures between",
+		observations[0].Time, "and", observations[len(observations)-1].Time)
+	return nil
+}
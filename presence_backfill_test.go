@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextTransition(t *testing.T) {
+	start := time.Date(2016, time.January, 3, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+
+	tests := []struct {
+		name      string
+		housemate Housemate
+		want      time.Time
+		ok        bool
+	}{
+		{"never seen", Housemate{}, time.Time{}, false},
+		{"seen while away", Housemate{Last_seen: at(0)}, at(0), true},
+		{"seen before they left", Housemate{Last_seen: at(0), StateChanged: at(10)}, time.Time{}, false},
+		{"arrival debounced", Housemate{Last_seen: at(0), StateChanged: at(-1), Debounce: 5 * time.Minute},
+			at(4), true},
+		{"debounced past the away timeout", Housemate{Last_seen: at(0), StateChanged: at(-1),
+			Debounce: 15 * time.Minute}, time.Time{}, false},
+		{"home", Housemate{Home: true, Last_seen: at(0)}, at(10), true},
+		{"home with a longer timeout", Housemate{Home: true, Last_seen: at(0), AwayTimeout: time.Hour},
+			at(60), true},
+		{"departure debounced", Housemate{Home: true, Last_seen: at(0), StateChanged: at(0),
+			Debounce: 15 * time.Minute}, at(15), true},
+	}
+	for _, test := range tests {
+		h := test.housemate
+		if h.AwayTimeout == 0 {
+			h.AwayTimeout = PRESENCE_DEFAULT_AWAY_TIMEOUT
+		}
+		got, ok := h.nextTransition()
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestBackfillAdvance(t *testing.T) {
+	start := time.Date(2016, time.January, 3, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+
+	type transition struct {
+		home bool
+		at   time.Time
+	}
+	tests := []struct {
+		name      string
+		debounce  time.Duration
+		sightings []int
+		want      []transition
+	}{
+		{"one visit", 0, []int{0, 3}, []transition{{true, at(0)}}},
+		{"out and back", 5 * time.Minute, []int{0, 3, 30, 31, 33},
+			[]transition{{true, at(0)}, {false, at(13)}, {true, at(30)}}},
+		{"back too soon to count", 5 * time.Minute, []int{0, 12},
+			[]transition{{true, at(0)}, {false, at(10)}}},
+		{"back after the debounce", 5 * time.Minute, []int{0, 12, 16},
+			[]transition{{true, at(0)}, {false, at(10)}, {true, at(15)}}},
+	}
+	for _, test := range tests {
+		h := &Housemate{AwayTimeout: PRESENCE_DEFAULT_AWAY_TIMEOUT, Debounce: test.debounce}
+		b := &PresenceBackfill{housemates: []*Housemate{h}}
+
+		// As Run does, without any logs or database
+		var got []transition
+		record := func(changed *Housemate, when time.Time) error {
+			got = append(got, transition{changed.Home, when})
+			return nil
+		}
+		for _, minutes := range test.sightings {
+			b.advance(at(minutes), record)
+			h.Last_seen = at(minutes)
+		}
+		b.advance(at(test.sightings[len(test.sightings)-1]), record)
+
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i].home != test.want[i].home || !got[i].at.Equal(test.want[i].at) {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+/*
+DHCP lease file presence sources
+
+Polls the lease databases of ISC dhcpd and dnsmasq, reporting a device as seen
+whenever its lease is renewed.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type leaseInfo struct {
+	Hostname string
+	ClientId string
+	Seen     time.Time
+	Expiry   int64
+}
+
+type DhcpdLeasesSource struct {
+	path          string
+	poll_interval time.Duration
+	last_seen     map[string]time.Time
+}
+
+func NewDhcpdLeasesSource(path string, poll_interval time.Duration) *DhcpdLeasesSource {
+	t := new(DhcpdLeasesSource)
+	t.path = path
+	t.poll_interval = poll_interval
+	t.last_seen = make(map[string]time.Time)
+	return t
+}
+
+func (t *DhcpdLeasesSource) Name() string {
+	return PRESENCE_SOURCE_DHCPD_LEASES
+}
+
+func (t *DhcpdLeasesSource) Run(observations chan<- *PresenceObservation) error {
+	return pollFile(t.path, t.poll_interval, func(f *os.File, modified time.Time) error {
+		for mac, lease := range parseDhcpdLeases(f) {
+			if !lease.Seen.After(t.last_seen[mac]) {
+				continue
+			}
+			t.last_seen[mac] = lease.Seen
+			observations <- &PresenceObservation{
+				Mac:      mac,
+				Hostname: lease.Hostname,
+				ClientId: lease.ClientId,
+				Time:     lease.Seen,
+				Source:   t.Name(),
+			}
+		}
+		return nil
+	})
+}
+
+// Parse a lease time, either "<weekday> yyyy/mm/dd hh:mm:ss" in UTC or
+// "epoch <seconds>", depending on the db-time-format dhcpd is using.
+func parseDhcpdLeaseTime(fields []string) (time.Time, bool) {
+	if len(fields) >= 2 && fields[0] == "epoch" {
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(secs, 0), true
+	}
+	if len(fields) >= 3 {
+		ts, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2])
+		if err != nil {
+			return time.Time{}, false
+		}
+		return ts, true
+	}
+	return time.Time{}, false
+}
+
+// Read a dhcpd.leases file, returning the latest client transaction time seen
+// for each hardware address.
+func parseDhcpdLeases(f *os.File) map[string]*leaseInfo {
+	seen := make(map[string]*leaseInfo)
+
+	var mac, hostname, client_id string
+	var last_transaction time.Time
+	in_lease := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		line = strings.TrimSuffix(line, ";")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "lease" && fields[len(fields)-1] == "{":
+			in_lease = true
+			mac = ""
+			hostname = ""
+			client_id = ""
+			last_transaction = time.Time{}
+		case fields[0] == "}":
+			if in_lease && mac != "" && !last_transaction.IsZero() {
+				if seen[mac] == nil || last_transaction.After(seen[mac].Seen) {
+					seen[mac] = &leaseInfo{
+						Hostname: hostname,
+						ClientId: client_id,
+						Seen:     last_transaction,
+					}
+				}
+			}
+			in_lease = false
+		case !in_lease:
+			continue
+		case fields[0] == "hardware" && len(fields) >= 3:
+			mac = fields[2]
+		case fields[0] == "uid" && len(fields) >= 2:
+			client_id = decodeDhcpdUid(strings.Join(fields[1:], " "))
+		case fields[0] == "client-hostname" && len(fields) >= 2:
+			hostname = strings.Trim(strings.Join(fields[1:], " "), "\"")
+		case fields[0] == "cltt":
+			if ts, ok := parseDhcpdLeaseTime(fields[1:]); ok {
+				last_transaction = ts
+			}
+		case fields[0] == "starts":
+			// Older leases may lack a cltt, in which case the lease start
+			// is the best we have
+			if ts, ok := parseDhcpdLeaseTime(fields[1:]); ok && last_transaction.IsZero() {
+				last_transaction = ts
+			}
+		}
+	}
+	return seen
+}
+
+// Client identifiers are written either as a quoted string with octal escapes,
+// or as colon separated hex. Either way, return them as colon separated hex.
+func decodeDhcpdUid(uid string) string {
+	if !strings.HasPrefix(uid, "\"") {
+		return uid
+	}
+	uid = strings.TrimSuffix(strings.TrimPrefix(uid, "\""), "\"")
+	octets := make([]string, 0, len(uid))
+	for i := 0; i < len(uid); i++ {
+		c := uid[i]
+		if c == '\\' && i+3 < len(uid) {
+			if n, err := strconv.ParseUint(uid[i+1:i+4], 8, 8); err == nil {
+				c = byte(n)
+				i += 3
+			} else {
+				c = uid[i+1]
+				i++
+			}
+		} else if c == '\\' && i+1 < len(uid) {
+			c = uid[i+1]
+			i++
+		}
+		octets = append(octets, fmt.Sprintf("%02x", c))
+	}
+	return strings.Join(octets, ":")
+}
+
+type DnsmasqLeasesSource struct {
+	path          string
+	poll_interval time.Duration
+	leases        map[string]*leaseInfo
+}
+
+func NewDnsmasqLeasesSource(path string, poll_interval time.Duration) *DnsmasqLeasesSource {
+	t := new(DnsmasqLeasesSource)
+	t.path = path
+	t.poll_interval = poll_interval
+	return t
+}
+
+func (t *DnsmasqLeasesSource) Name() string {
+	return PRESENCE_SOURCE_DNSMASQ_LEASES
+}
+
+// dnsmasq only records when each lease expires, so a device is considered
+// seen whenever its expiry moves forward. On the first pass every unexpired
+// lease counts, as of when the file was last written, so devices that already
+// hold a lease at startup aren't missed.
+func (t *DnsmasqLeasesSource) Run(observations chan<- *PresenceObservation) error {
+	return pollFile(t.path, t.poll_interval, func(f *os.File, modified time.Time) error {
+		leases := parseDnsmasqLeases(f)
+		now := time.Now().Unix()
+		for mac, lease := range leases {
+			if t.leases == nil {
+				// An expiry of 0 is an infinite lease
+				if lease.Expiry != 0 && lease.Expiry < now {
+					continue
+				}
+			} else if previous := t.leases[mac]; previous != nil && lease.Expiry <= previous.Expiry {
+				continue
+			}
+			observations <- &PresenceObservation{
+				Mac:      mac,
+				Hostname: lease.Hostname,
+				ClientId: lease.ClientId,
+				Time:     modified,
+				Source:   t.Name(),
+			}
+		}
+		t.leases = leases
+		return nil
+	})
+}
+
+// Lines are "<expiry> <mac> <ip> <hostname> <client id>"
+func parseDnsmasqLeases(f *os.File) map[string]*leaseInfo {
+	leases := make(map[string]*leaseInfo)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		lease := &leaseInfo{Expiry: expiry}
+		// Unknown hostnames are written as "*"
+		if len(fields) >= 4 && fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		if len(fields) >= 5 && fields[4] != "*" {
+			lease.ClientId = fields[4]
+		}
+		leases[fields[1]] = lease
+	}
+	return leases
+}
+
+// Call the handler with the file's contents every time it is modified
+func pollFile(path string, interval time.Duration, handler func(*os.File, time.Time) error) error {
+	var last_modified time.Time
+	for {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(last_modified) {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			err = handler(f, info.ModTime())
+			f.Close()
+			if err != nil {
+				return err
+			}
+			last_modified = info.ModTime()
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// A file holding the given contents, for parsers that read leases files
+func leasesFile(t *testing.T, contents string) *os.File {
+	f, err := ioutil.TempFile("", "ernest-leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestDecodeDhcpdUid(t *testing.T) {
+	tests := []struct {
+		uid  string
+		want string
+	}{
+		{`"\001\252\273\314\335\356\377"`, "01:aa:bb:cc:dd:ee:ff"},
+		{`"abc"`, "61:62:63"},
+		{`"\001abc"`, "01:61:62:63"},
+		{`"\"x"`, "22:78"},
+		{`"\\"`, "5c"},
+		{`"\9ab"`, "39:61:62"},
+		{`""`, ""},
+		{"01:aa:bb:cc:dd:ee:ff", "01:aa:bb:cc:dd:ee:ff"},
+	}
+	for _, test := range tests {
+		if got := decodeDhcpdUid(test.uid); got != test.want {
+			t.Errorf("decodeDhcpdUid(%s) = %q, want %q", test.uid, got, test.want)
+		}
+	}
+}
+
+func TestParseDhcpdLeaseTime(t *testing.T) {
+	tests := []struct {
+		fields []string
+		want   time.Time
+		ok     bool
+	}{
+		{[]string{"4", "2016/01/07", "21:00:00"}, time.Date(2016, time.January, 7, 21, 0, 0, 0, time.UTC), true},
+		{[]string{"epoch", "1452200400"}, time.Unix(1452200400, 0), true},
+		{[]string{"never"}, time.Time{}, false},
+		{[]string{"epoch", "soon"}, time.Time{}, false},
+		{[]string{"4", "07/01/2016", "21:00:00"}, time.Time{}, false},
+		{nil, time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseDhcpdLeaseTime(test.fields)
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("parseDhcpdLeaseTime(%q) = %v, %v, want %v, %v", test.fields, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseDhcpdLeases(t *testing.T) {
+	f := leasesFile(t, `# The format of this file is documented in the dhcpd.leases(5) manual page.
+authoring-byte-order little-endian;
+
+lease 10.0.0.5 {
+  starts 4 2016/01/07 20:00:00;
+  ends 4 2016/01/07 22:00:00;
+  cltt 4 2016/01/07 21:00:00;
+  binding state active;
+  hardware ethernet aa:bb:cc:dd:ee:ff;
+  uid "\001\252\273\314\335\356\377";
+  client-hostname "Pixel 7";
+}
+lease 10.0.0.9 {
+  cltt 4 2016/01/07 20:30:00;
+  hardware ethernet aa:bb:cc:dd:ee:ff;
+}
+lease 10.0.0.6 {
+  starts epoch 1452200000; # Thu Jan 07 20:53:20 2016
+  hardware ethernet 11:22:33:44:55:66;
+}
+lease 10.0.0.7 {
+  hardware ethernet 77:77:77:77:77:77;
+}
+hardware ethernet 99:99:99:99:99:99;
+cltt 4 2016/01/07 21:00:00;
+`)
+	defer f.Close()
+
+	want := map[string]*leaseInfo{
+		"aa:bb:cc:dd:ee:ff": {
+			Hostname: "Pixel 7",
+			ClientId: "01:aa:bb:cc:dd:ee:ff",
+			Seen:     time.Date(2016, time.January, 7, 21, 0, 0, 0, time.UTC),
+		},
+		"11:22:33:44:55:66": {Seen: time.Unix(1452200000, 0)},
+	}
+	got := parseDhcpdLeases(f)
+	if len(got) != len(want) {
+		t.Errorf("got %d leases, want %d", len(got), len(want))
+	}
+	for mac, lease := range want {
+		g := got[mac]
+		if g == nil {
+			t.Errorf("%s: missing", mac)
+			continue
+		}
+		if g.Hostname != lease.Hostname || g.ClientId != lease.ClientId || !g.Seen.Equal(lease.Seen) {
+			t.Errorf("%s: got %+v, want %+v", mac, g, lease)
+		}
+	}
+}
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	f := leasesFile(t, `1452204000 aa:bb:cc:dd:ee:ff 10.0.0.5 phone 01:aa:bb:cc:dd:ee:ff
+0 11:22:33:44:55:66 10.0.0.6 * *
+1452204000 77:77:77:77:77:77
+not-a-number 99:99:99:99:99:99 10.0.0.9 x *
+1452204000
+`)
+	defer f.Close()
+
+	want := map[string]leaseInfo{
+		"aa:bb:cc:dd:ee:ff": {Hostname: "phone", ClientId: "01:aa:bb:cc:dd:ee:ff", Expiry: 1452204000},
+		"11:22:33:44:55:66": {Expiry: 0},
+		"77:77:77:77:77:77": {Expiry: 1452204000},
+	}
+	got := parseDnsmasqLeases(f)
+	if len(got) != len(want) {
+		t.Errorf("got %d leases, want %d", len(got), len(want))
+	}
+	for mac, lease := range want {
+		if got[mac] == nil {
+			t.Errorf("%s: missing", mac)
+		} else if *got[mac] != lease {
+			t.Errorf("%s: got %+v, want %+v", mac, got[mac], lease)
+		}
+	}
+}
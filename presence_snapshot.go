@@ -0,0 +1,105 @@
+/*
+Presence snapshots
+
+Housemates are only ever modified by the presence loop. Everything else reads
+presence from a snapshot: a deep copy taken after each change, which is never
+modified once published and so is safe to share between goroutines.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+type PresenceSnapshot struct {
+	Taken  time.Time
+	People []*Housemate
+}
+
+func copyHousemate(h *Housemate) *Housemate {
+	c := *h
+	c.Devices = make([]*Device, 0, len(h.Devices))
+	c.LastDevice = nil
+	for _, d := range h.Devices {
+		device := *d
+		c.Devices = append(c.Devices, &device)
+		if d == h.LastDevice {
+			c.LastDevice = &device
+		}
+	}
+	return &c
+}
+
+// Publish a copy of the current presence state. Must be called from the
+// presence loop, or before it starts.
+func (t *DhcpStatus) publishSnapshot(now time.Time) {
+	snapshot := new(PresenceSnapshot)
+	snapshot.Taken = now
+	snapshot.People = make([]*Housemate, 0, len(t.housemates))
+	for _, h := range t.housemates {
+		snapshot.People = append(snapshot.People, copyHousemate(h))
+	}
+
+	t.snapshot_mutex.Lock()
+	t.snapshot = snapshot
+	t.snapshot_mutex.Unlock()
+}
+
+// The latest presence state. Callers must not modify it.
+func (t *DhcpStatus) Snapshot() *PresenceSnapshot {
+	t.snapshot_mutex.RLock()
+	defer t.snapshot_mutex.RUnlock()
+	return t.snapshot
+}
+
+func (s *PresenceSnapshot) Person(id int64) *Housemate {
+	for _, h := range s.People {
+		if h.Id == id {
+			return h
+		}
+	}
+	return nil
+}
+
+func (s *PresenceSnapshot) Device(id int64) *Device {
+	for _, h := range s.People {
+		for _, d := range h.Devices {
+			if d.Id == id {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+func (s *PresenceSnapshot) LastPersonActive() *Housemate {
+	if len(s.People) == 0 {
+		return nil
+	}
+	last_seen := s.People[0]
+	for _, person := range s.People {
+		if person.Last_seen.After(last_seen.Last_seen) {
+			last_seen = person
+		}
+	}
+	return last_seen
+}
+
+func (s *PresenceSnapshot) AnybodyHome() bool {
+	for _, person := range s.People {
+		if person.isHome() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PresenceSnapshot) AnybodyNear(now time.Time) bool {
+	for _, person := range s.People {
+		if person.isNear(now) {
+			return true
+		}
+	}
+	return false
+}
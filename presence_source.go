@@ -0,0 +1,118 @@
+/*
+Presence sources
+
+A presence source watches something on the network for signs of life from
+devices, and reports each sighting as an observation. Any number of sources
+can be enabled at once; DhcpStatus merges their observations into each
+housemate's last seen time.
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const PRESENCE_SOURCE_SYSLOG = "syslog"
+const PRESENCE_SOURCE_DHCPD_LEASES = "dhcpd-leases"
+const PRESENCE_SOURCE_DNSMASQ_LEASES = "dnsmasq-leases"
+const PRESENCE_SOURCE_ARP = "arp"
+const PRESENCE_SOURCE_SYSLOG_LISTENER = "syslog-listener"
+
+const PRESENCE_DEFAULT_SYSLOG_PATH = "/var/log/syslog"
+const PRESENCE_DEFAULT_DHCPD_LEASES_PATH = "/var/lib/dhcp/dhcpd.leases"
+const PRESENCE_DEFAULT_DNSMASQ_LEASES_PATH = "/var/lib/misc/dnsmasq.leases"
+const PRESENCE_DEFAULT_ARP_PATH = "/proc/net/arp"
+const PRESENCE_DEFAULT_POLL_INTERVAL = 30 * time.Second
+const PRESENCE_DEFAULT_SYSLOG_PROGRAM = "dhcpd"
+
+type PresenceObservation struct {
+	Mac string
+	// DHCP hostname of the device, where the source knows it
+	Hostname string
+	// DHCP client identifier, where the source knows it
+	ClientId string
+	Time     time.Time
+	Source   string
+}
+
+type PresenceSource interface {
+	Name() string
+	// Watch for devices, sending observations until something goes
+	// irrecoverably wrong.
+	Run(observations chan<- *PresenceObservation) error
+}
+
+// Sources that can look back over what happened while the server was down
+type BackfillingSource interface {
+	PresenceSource
+	Backfill(since time.Time, observations chan<- *PresenceObservation) error
+}
+
+func (c *Config) PresencePollInterval() time.Duration {
+	if c.Presence.PollSeconds <= 0 {
+		return PRESENCE_DEFAULT_POLL_INTERVAL
+	}
+	return time.Duration(c.Presence.PollSeconds) * time.Second
+}
+
+// Programs whose syslog lines are checked for MACs
+func (c *Config) SyslogPrograms() []string {
+	if len(c.Presence.SyslogProgram) == 0 {
+		return []string{PRESENCE_DEFAULT_SYSLOG_PROGRAM}
+	}
+	return c.Presence.SyslogProgram
+}
+
+func orDefault(path, fallback string) string {
+	if path == "" {
+		return fallback
+	}
+	return path
+}
+
+// Build the presence sources enabled in the config. If none are listed, fall
+// back to tailing syslog.
+func NewPresenceSources(c *Config) []PresenceSource {
+	names := c.Presence.Source
+	if len(names) == 0 {
+		names = []string{PRESENCE_SOURCE_SYSLOG}
+	}
+
+	sources := make([]PresenceSource, 0)
+	for _, name := range names {
+		switch name {
+		case PRESENCE_SOURCE_SYSLOG:
+			sources = append(sources, NewSyslogSource(
+				orDefault(c.Presence.SyslogPath, PRESENCE_DEFAULT_SYSLOG_PATH),
+				c.SyslogPrograms(),
+			))
+		case PRESENCE_SOURCE_SYSLOG_LISTENER:
+			sources = append(sources, NewSyslogListenerSource(
+				c.Presence.ListenAddress+":"+
+					orDefault(c.Presence.ListenPort, PRESENCE_DEFAULT_LISTEN_PORT),
+				c.Presence.ListenAllow,
+				c.SyslogPrograms(),
+			))
+		case PRESENCE_SOURCE_DHCPD_LEASES:
+			sources = append(sources, NewDhcpdLeasesSource(
+				orDefault(c.Presence.DhcpdLeasesPath, PRESENCE_DEFAULT_DHCPD_LEASES_PATH),
+				c.PresencePollInterval(),
+			))
+		case PRESENCE_SOURCE_DNSMASQ_LEASES:
+			sources = append(sources, NewDnsmasqLeasesSource(
+				orDefault(c.Presence.DnsmasqLeasesPath, PRESENCE_DEFAULT_DNSMASQ_LEASES_PATH),
+				c.PresencePollInterval(),
+			))
+		case PRESENCE_SOURCE_ARP:
+			sources = append(sources, NewArpSource(
+				orDefault(c.Presence.ArpPath, PRESENCE_DEFAULT_ARP_PATH),
+				c.PresencePollInterval(),
+			))
+		default:
+			log.Println("Unknown presence source", name)
+		}
+	}
+	return sources
+}
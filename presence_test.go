@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingEvent(t *testing.T) {
+	now := time.Date(2016, time.January, 3, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	tests := []struct {
+		name      string
+		housemate Housemate
+		want      string
+	}{
+		{
+			"seen while away",
+			Housemate{Last_seen: ago(time.Minute), StateChanged: ago(time.Hour)},
+			PRESENCE_EVENT_ARRIVE,
+		},
+		{
+			"seen while home",
+			Housemate{Home: true, Last_seen: ago(time.Minute), StateChanged: ago(time.Hour)},
+			"",
+		},
+		{
+			"not seen for the away timeout",
+			Housemate{Home: true, Last_seen: ago(10 * time.Minute), StateChanged: ago(time.Hour)},
+			PRESENCE_EVENT_LEAVE,
+		},
+		{
+			"not seen for a while, within a longer timeout",
+			Housemate{Home: true, Last_seen: ago(20 * time.Minute), StateChanged: ago(time.Hour),
+				AwayTimeout: 30 * time.Minute},
+			"",
+		},
+		{
+			"never seen",
+			Housemate{StateChanged: ago(time.Hour)},
+			"",
+		},
+		{
+			"arrival held by the debounce",
+			Housemate{Last_seen: ago(time.Minute), StateChanged: ago(2 * time.Minute), Debounce: 5 * time.Minute},
+			"",
+		},
+		{
+			"arrival after the debounce",
+			Housemate{Last_seen: ago(time.Minute), StateChanged: ago(5 * time.Minute), Debounce: 5 * time.Minute},
+			PRESENCE_EVENT_ARRIVE,
+		},
+		{
+			"departure held by the debounce",
+			Housemate{Home: true, Last_seen: ago(15 * time.Minute), StateChanged: ago(2 * time.Minute),
+				Debounce: 5 * time.Minute},
+			"",
+		},
+		{
+			"explicit report skips the debounce",
+			Housemate{Last_seen: ago(time.Minute), StateChanged: ago(2 * time.Minute), Debounce: 5 * time.Minute,
+				skip_debounce: true},
+			PRESENCE_EVENT_ARRIVE,
+		},
+		{
+			"explicit departure overrides earlier sightings",
+			Housemate{Home: true, Last_seen: ago(2 * time.Minute), LeftAt: ago(time.Minute),
+				StateChanged: ago(time.Hour)},
+			PRESENCE_EVENT_LEAVE,
+		},
+		{
+			"sighting after an explicit departure",
+			Housemate{Last_seen: ago(time.Minute), LeftAt: ago(2 * time.Minute), StateChanged: ago(time.Hour)},
+			PRESENCE_EVENT_ARRIVE,
+		},
+		{
+			"pinned without being seen",
+			Housemate{Pinned: true, pinned_until: now.Add(time.Hour), StateChanged: ago(time.Hour)},
+			PRESENCE_EVENT_ARRIVE,
+		},
+		{
+			"pinned and home past the away timeout",
+			Housemate{Home: true, Pinned: true, pinned_until: now.Add(time.Hour), Last_seen: ago(time.Hour),
+				StateChanged: ago(time.Hour)},
+			"",
+		},
+		{
+			"pin run out",
+			Housemate{Home: true, Pinned: true, pinned_until: ago(time.Second), Last_seen: ago(time.Hour),
+				StateChanged: ago(time.Hour)},
+			PRESENCE_EVENT_LEAVE,
+		},
+	}
+
+	for _, test := range tests {
+		h := test.housemate
+		if h.AwayTimeout == 0 {
+			h.AwayTimeout = PRESENCE_DEFAULT_AWAY_TIMEOUT
+		}
+		if got := h.pendingEvent(now); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPendingEventSkipsDebounceOnce(t *testing.T) {
+	now := time.Date(2016, time.January, 3, 12, 0, 0, 0, time.UTC)
+	h := &Housemate{
+		Last_seen:     now,
+		StateChanged:  now.Add(-time.Minute),
+		AwayTimeout:   PRESENCE_DEFAULT_AWAY_TIMEOUT,
+		Debounce:      5 * time.Minute,
+		skip_debounce: true,
+	}
+	if got := h.pendingEvent(now); got != PRESENCE_EVENT_ARRIVE {
+		t.Fatalf("got %q, want %q", got, PRESENCE_EVENT_ARRIVE)
+	}
+	h.Home = true
+	h.StateChanged = now
+	h.LeftAt = now.Add(time.Second)
+	if got := h.pendingEvent(now.Add(time.Minute)); got != "" {
+		t.Errorf("departure straight after got %q, want the debounce to hold it", got)
+	}
+}
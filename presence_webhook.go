@@ -0,0 +1,60 @@
+/*
+Presence webhooks
+
+Posts every arrival and departure as JSON to each configured URL, including
+guests arriving and leaving, which have no PersonId.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const PRESENCE_WEBHOOK_TIMEOUT = 10 * time.Second
+
+type PresenceWebhooks struct {
+	urls   []string
+	client *http.Client
+	events <-chan *PresenceEvent
+}
+
+func NewPresenceWebhooks(c *Config, d *DhcpStatus) *PresenceWebhooks {
+	t := new(PresenceWebhooks)
+	t.urls = c.Presence.EventWebhook
+	t.client = &http.Client{Timeout: PRESENCE_WEBHOOK_TIMEOUT}
+	t.events = d.Subscribe()
+	return t
+}
+
+func (t *PresenceWebhooks) Run() {
+	for event := range t.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, url := range t.urls {
+			if err := t.post(url, body); err != nil {
+				log.Println("Presence webhook", url, "failed:", err)
+			}
+		}
+	}
+}
+
+func (t *PresenceWebhooks) post(url string, body []byte) error {
+	resp, err := t.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Got status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+/*
+Readings rollup module
+
+Periodically aggregates raw readings into minute, hourly and daily tables
+holding the min, max, mean and count of each metric, and prunes every
+resolution according to the configured retention. Nothing is pruned until it
+has been rolled up into the next resolution.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	"log"
+	"strings"
+	"time"
+)
+
+type Resolution struct {
+	Name    string
+	Table   string
+	Bucket  time.Duration
+	MaxSpan time.Duration
+}
+
+var RESOLUTION_RAW = &Resolution{"raw", "readings", 0, time.Hour * 6}
+var RESOLUTION_MINUTE = &Resolution{"minute", "readings_minute", time.Minute, time.Hour * 24 * 8}
+var RESOLUTION_HOURLY = &Resolution{"hourly", "readings_hourly", time.Hour, time.Hour * 24 * 180}
+var RESOLUTION_DAILY = &Resolution{"daily", "readings_daily", time.Hour * 24, 0}
+
+// Ordered finest first
+var RESOLUTIONS = []*Resolution{
+	RESOLUTION_RAW,
+	RESOLUTION_MINUTE,
+	RESOLUTION_HOURLY,
+	RESOLUTION_DAILY,
+}
+
+var READING_METRICS = []string{"temp", "pressure", "humidity"}
+
+// Each rollup table is built from the next finest one
+var ROLLUP_SOURCES = map[*Resolution]*Resolution{
+	RESOLUTION_MINUTE: RESOLUTION_RAW,
+	RESOLUTION_HOURLY: RESOLUTION_MINUTE,
+	RESOLUTION_DAILY:  RESOLUTION_HOURLY,
+}
+
+// Days of data kept at each resolution when the config doesn't say. Raw
+// readings are only pruned if asked for.
+const RETENTION_DEFAULT_RAW_DAYS = -1
+const RETENTION_DEFAULT_MINUTE_DAYS = 30
+const RETENTION_DEFAULT_HOURLY_DAYS = 365
+const RETENTION_DEFAULT_DAILY_DAYS = -1
+
+// Extra metrics sent with readings are pruned along with the raw readings
+const READING_METRICS_TABLE = "reading_metrics"
+
+// Most source data aggregated by one query, so catching up on a long history
+// doesn't mean one huge GROUP BY
+const ROLLUP_MAX_WINDOW = time.Hour * 24 * 7
+
+// How long to keep data at a given resolution. Zero means forever. Unset
+// entries in the config use the defaults above, and negative ones mean
+// forever.
+func (c *Config) RetentionFor(res *Resolution) time.Duration {
+	var days, default_days int
+	switch res {
+	case RESOLUTION_RAW:
+		days, default_days = c.Retention.RawDays, RETENTION_DEFAULT_RAW_DAYS
+	case RESOLUTION_MINUTE:
+		days, default_days = c.Retention.MinuteDays, RETENTION_DEFAULT_MINUTE_DAYS
+	case RESOLUTION_HOURLY:
+		days, default_days = c.Retention.HourlyDays, RETENTION_DEFAULT_HOURLY_DAYS
+	case RESOLUTION_DAILY:
+		days, default_days = c.Retention.DailyDays, RETENTION_DEFAULT_DAILY_DAYS
+	}
+	if days == 0 {
+		days = default_days
+	}
+	if days < 0 {
+		return 0
+	}
+	return time.Duration(days) * time.Hour * 24
+}
+
+// Whether data at this resolution still goes back the given age
+func (c *Config) Retains(res *Resolution, age time.Duration) bool {
+	retention := c.RetentionFor(res)
+	return retention == 0 || age <= retention
+}
+
+// Pick the finest resolution that can sensibly display the given period and
+// that still has data going back the given age, which is how long ago the
+// period starts.
+func chooseResolution(c *Config, period, age time.Duration) *Resolution {
+	for _, res := range RESOLUTIONS {
+		if res.MaxSpan != 0 && period > res.MaxSpan {
+			continue
+		}
+		if !c.Retains(res, age) {
+			continue
+		}
+		return res
+	}
+	return RESOLUTION_DAILY
+}
+
+type ReadingRollups struct {
+	db     *sql.DB
+	config *Config
+}
+
+func NewReadingRollups(c *Config) *ReadingRollups {
+	t := new(ReadingRollups)
+
+	db, err := sql.Open("mysql", c.GetSqlURI())
+	if err != nil {
+		log.Println(err)
+	}
+	t.db = db
+	t.config = c
+
+	return t
+}
+
+func (t *ReadingRollups) Run() {
+	for {
+		// How far each source table has been rolled up this pass
+		rolled_up := make(map[*Resolution]time.Time)
+		for _, res := range RESOLUTIONS[1:] {
+			until, err := t.rollup(res)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			rolled_up[ROLLUP_SOURCES[res]] = until
+		}
+
+		for i, res := range RESOLUTIONS {
+			before := time.Now()
+			// Tables that something is built from wait for it to be built
+			if i < len(RESOLUTIONS)-1 {
+				until, ok := rolled_up[res]
+				if !ok {
+					continue
+				}
+				before = until
+			}
+			if err := t.prune(res.Table, t.config.RetentionFor(res), before); err != nil {
+				log.Println(err)
+			}
+		}
+		if until, ok := rolled_up[RESOLUTION_RAW]; ok {
+			if err := t.prune(READING_METRICS_TABLE, t.config.RetentionFor(RESOLUTION_RAW), until); err != nil {
+				log.Println(err)
+			}
+		}
+		time.Sleep(1 * time.Minute)
+	}
+}
+
+// Aggregate expressions for reading a metric out of the given source table
+func rollupSelectColumns(source *Resolution, metric string) []string {
+	if source == RESOLUTION_RAW {
+		return []string{
+			fmt.Sprintf("MIN(%s)", metric),
+			fmt.Sprintf("MAX(%s)", metric),
+			fmt.Sprintf("AVG(%s)", metric),
+			fmt.Sprintf("COUNT(%s)", metric),
+		}
+	}
+	return []string{
+		fmt.Sprintf("MIN(%s_min)", metric),
+		fmt.Sprintf("MAX(%s_max)", metric),
+		fmt.Sprintf("SUM(%s_mean * %s_count) / SUM(%s_count)", metric, metric, metric),
+		fmt.Sprintf("SUM(%s_count)", metric),
+	}
+}
+
+// Roll up the next window of the source table, returning the time before
+// which the source has been completely rolled up
+func (t *ReadingRollups) rollup(res *Resolution) (time.Time, error) {
+	source := ROLLUP_SOURCES[res]
+	now := time.Now()
+
+	// Start from the most recent bucket we have, since it may have been
+	// rolled up while still partially filled.
+	var last_bucket sql.NullTime
+	row := t.db.QueryRow(fmt.Sprintf("SELECT MAX(timestamp) FROM %s", res.Table))
+	if err := row.Scan(&last_bucket); err != nil {
+		return time.Time{}, err
+	}
+	since := time.Unix(0, 0)
+	if last_bucket.Valid {
+		since = last_bucket.Time
+	}
+
+	// Skip over any gap in the source, so an empty window can't stall us
+	var next sql.NullTime
+	row = t.db.QueryRow(fmt.Sprintf("SELECT MIN(timestamp) FROM %s WHERE timestamp >= ?", source.Table), since)
+	if err := row.Scan(&next); err != nil {
+		return time.Time{}, err
+	}
+	if !next.Valid {
+		return now.Truncate(res.Bucket), nil
+	}
+	if start := next.Time.Truncate(res.Bucket); start.After(since) {
+		since = start
+	}
+	until := since.Add(ROLLUP_MAX_WINDOW)
+	if until.After(now) {
+		until = now.Truncate(res.Bucket).Add(res.Bucket)
+	}
+
+	insert_columns := []string{"timestamp", "node_id"}
+	select_columns := []string{
+		fmt.Sprintf(
+			"FROM_UNIXTIME(UNIX_TIMESTAMP(timestamp) DIV %d * %d) AS bucket",
+			int64(res.Bucket.Seconds()), int64(res.Bucket.Seconds()),
+		),
+		"node_id",
+	}
+	updates := make([]string, 0)
+	for _, metric := range READING_METRICS {
+		for _, agg := range []string{"min", "max", "mean", "count"} {
+			column := metric + "_" + agg
+			insert_columns = append(insert_columns, column)
+			updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", column, column))
+		}
+		select_columns = append(select_columns, rollupSelectColumns(source, metric)...)
+	}
+
+	query := fmt.Sprintf(`INSERT INTO %s (%s)
+		SELECT %s FROM %s
+		WHERE timestamp >= ? AND timestamp < ?
+		GROUP BY bucket, node_id
+		ON DUPLICATE KEY UPDATE %s`,
+		res.Table, strings.Join(insert_columns, ", "),
+		strings.Join(select_columns, ", "), source.Table,
+		strings.Join(updates, ", "),
+	)
+	if _, err := t.db.Exec(query, since, until); err != nil {
+		return time.Time{}, err
+	}
+	// The bucket holding now is still filling up
+	if limit := now.Truncate(res.Bucket); until.After(limit) {
+		return limit, nil
+	}
+	return until, nil
+}
+
+// Delete anything older than the retention, as long as it's also from before
+// the given time
+func (t *ReadingRollups) prune(table string, retention time.Duration, before time.Time) error {
+	if retention == 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-retention)
+	if before.Before(cutoff) {
+		cutoff = before
+	}
+	_, err := t.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE timestamp < ?", table), cutoff)
+	return err
+}
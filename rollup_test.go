@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChooseResolution(t *testing.T) {
+	c := new(Config)
+	c.Retention.RawDays = 7
+	c.Retention.MinuteDays = 30
+	c.Retention.HourlyDays = 365
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name   string
+		period time.Duration
+		age    time.Duration
+		want   *Resolution
+	}{
+		{"last hour", time.Hour, time.Hour, RESOLUTION_RAW},
+		{"last day", day, day, RESOLUTION_MINUTE},
+		{"last week", 7 * day, 7 * day, RESOLUTION_MINUTE},
+		{"last month", 30 * day, 30 * day, RESOLUTION_HOURLY},
+		{"last year", 365 * day, 365 * day, RESOLUTION_DAILY},
+		{"an hour a month ago", time.Hour, 30 * day, RESOLUTION_MINUTE},
+		{"an hour two months ago", time.Hour, 60 * day, RESOLUTION_HOURLY},
+		{"a day two years ago", day, 730 * day, RESOLUTION_DAILY},
+		{"an hour just inside raw retention", time.Hour, 7 * day, RESOLUTION_RAW},
+	}
+	for _, test := range tests {
+		if got := chooseResolution(c, test.period, test.age); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got.Name, test.want.Name)
+		}
+	}
+
+	// Raw readings are kept forever unless configured otherwise
+	if got := chooseResolution(new(Config), time.Hour, 730*day); got != RESOLUTION_RAW {
+		t.Errorf("default retention: got %s, want raw", got.Name)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+HTTP routing
+
+Routes match a method and either an exact path or, for trees like the API, a
+path prefix. Exact paths win over prefixes, and longer prefixes over shorter
+ones, so overlapping routes always resolve the same way. Unknown paths get a
+404, and known paths with the wrong method a 405.
+
+Every request goes through the middleware chain: a request ID, access
+logging, slow request warnings and panic recovery.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Requests taking longer than this are logged as slow
+const SLOW_REQUEST = 2 * time.Second
+
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+type Route struct {
+	// Empty to accept any method
+	Methods []string
+	Path    string
+	Prefix  bool
+	Handler http.HandlerFunc
+}
+
+func (route *Route) allows(method string) bool {
+	if len(route.Methods) == 0 {
+		return true
+	}
+	for _, m := range route.Methods {
+		if m == method || (m == "GET" && method == "HEAD") {
+			return true
+		}
+	}
+	return false
+}
+
+type Router struct {
+	exact    map[string][]*Route
+	prefixes []*Route
+}
+
+func NewRouter() *Router {
+	t := new(Router)
+	t.exact = make(map[string][]*Route)
+	return t
+}
+
+// Route an exact path. No methods means any method.
+func (t *Router) Handle(path string, handler http.HandlerFunc, methods ...string) {
+	t.exact[path] = append(t.exact[path], &Route{methods, path, false, handler})
+}
+
+// Route every path under a prefix
+func (t *Router) HandlePrefix(prefix string, handler http.HandlerFunc, methods ...string) {
+	t.prefixes = append(t.prefixes, &Route{methods, prefix, true, handler})
+	sort.SliceStable(t.prefixes, func(i, j int) bool {
+		return len(t.prefixes[i].Path) > len(t.prefixes[j].Path)
+	})
+}
+
+// Routes for a path, most specific first
+func (t *Router) match(path string) []*Route {
+	if routes, ok := t.exact[path]; ok {
+		return routes
+	}
+	for i, route := range t.prefixes {
+		if strings.HasPrefix(path, route.Path) {
+			// Every route sharing the longest matching prefix
+			routes := []*Route{route}
+			for _, other := range t.prefixes[i+1:] {
+				if other.Path == route.Path {
+					routes = append(routes, other)
+				}
+			}
+			return routes
+		}
+	}
+	return nil
+}
+
+func (t *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	routes := t.match(r.URL.Path)
+	if len(routes) == 0 {
+		if isApiRequest(r) {
+			writeJsonError(w, http.StatusNotFound, "not_found", "No such resource")
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	allowed := make([]string, 0)
+	for _, route := range routes {
+		if route.allows(r.Method) {
+			route.Handler(w, r)
+			return
+		}
+		allowed = append(allowed, route.Methods...)
+	}
+	if isApiRequest(r) {
+		methodNotAllowed(w, allowed...)
+	} else {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Details of a request shared between the middleware and the handlers
+type RequestInfo struct {
+	Id      string
+	Started time.Time
+	// Set once the request is authenticated
+	User string
+}
+
+type requestInfoKey struct{}
+
+func requestInfo(r *http.Request) *RequestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// Records the status and size of a response for the access log
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Streaming responses need to flush as they go
+func (w *responseRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("Connection can't be hijacked")
+}
+
+type Middleware func(http.Handler) http.Handler
+
+// Wrap a handler in middleware, the first being outermost
+func chain(handler http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+func newRequestId() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		log.Println(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Tag every request with an ID, reusing one set by a proxy in front of us
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if id == "" || len(id) > 64 || strings.ContainsAny(id, " \t\r\n") {
+			id = newRequestId()
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		info := &RequestInfo{Id: id, Started: time.Now()}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+	})
+}
+
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		info := requestInfo(r)
+		user := "-"
+		if info.User != "" {
+			user = info.User
+		}
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		log.Printf("%s %s %s %s %d %dB %s [%s]", r.RemoteAddr, user, r.Method,
+			r.URL.Path, recorder.status, recorder.bytes,
+			time.Now().Sub(info.Started).Round(time.Millisecond), info.Id)
+	})
+}
+
+// Warn about slow requests. Streams are expected to run for a long time.
+func withTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		info := requestInfo(r)
+		elapsed := time.Now().Sub(info.Started)
+		if elapsed > SLOW_REQUEST && r.Header.Get("Accept") != "text/event-stream" {
+			log.Printf("Slow request: %s %s took %s [%s]", r.Method, r.URL.Path,
+				elapsed.Round(time.Millisecond), info.Id)
+		}
+	})
+}
+
+// Turn a panicking handler into a 500, rather than a dropped connection
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Printf("Panic serving %s %s [%s]: %v\n%s", r.Method, r.URL.Path,
+					requestInfo(r).Id, err, debug.Stack())
+				if recorder, ok := w.(*responseRecorder); ok && recorder.status != 0 {
+					// Too late to send an error
+					return
+				}
+				if isApiRequest(r) {
+					writeJsonError(w, http.StatusInternalServerError, "internal", "Internal error")
+				} else {
+					http.Error(w, "Internal error", http.StatusInternalServerError)
+				}
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
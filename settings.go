@@ -0,0 +1,683 @@
+/*
+Settings registry
+
+Declares every setting the server knows about, along with its type, unit,
+allowed range and default. All reads and writes of the settings table go
+through here, so values are validated before they are stored and every
+change is recorded in the settings history.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SETTING_IDLE_TEMP = "idle_temp"
+const SETTING_ACTIVE_TEMP = "min_temp"
+const SETTING_OVERRIDE = "override"
+const SETTING_FURNACE_ON = "furnace_on"
+const SETTING_PRIMARY_NODE = "primary_node"
+const SETTING_GUEST_MODE = "guest_mode"
+const SETTING_HYSTERESIS = "hysteresis"
+const SETTING_POLL_INTERVAL = "poll_interval"
+
+type SettingType string
+
+const SETTING_TYPE_FLOAT SettingType = "float"
+const SETTING_TYPE_INT SettingType = "int"
+const SETTING_TYPE_BOOL SettingType = "bool"
+
+type SettingDef struct {
+	Key         string
+	Type        SettingType
+	Unit        string
+	Min         float64
+	Max         float64
+	Default     string
+	Description string
+	// Internal settings hold server state, and aren't user editable
+	Internal bool
+}
+
+var SETTINGS_REGISTRY = []*SettingDef{
+	{
+		Key:         SETTING_ACTIVE_TEMP,
+		Type:        SETTING_TYPE_FLOAT,
+		Unit:        "°C",
+		Min:         0,
+		Max:         30,
+		Default:     "15.5",
+		Description: "Temperature to keep the house at when somebody is home",
+	},
+	{
+		Key:         SETTING_IDLE_TEMP,
+		Type:        SETTING_TYPE_FLOAT,
+		Unit:        "°C",
+		Min:         0,
+		Max:         30,
+		Default:     "12.5",
+		Description: "Temperature to keep the house at when nobody is home",
+	},
+	{
+		Key:         SETTING_HYSTERESIS,
+		Type:        SETTING_TYPE_FLOAT,
+		Unit:        "%",
+		Min:         0,
+		Max:         50,
+		Default:     "5",
+		Description: "How far above the target temperature the furnace keeps running once it's on",
+	},
+	{
+		Key:         SETTING_POLL_INTERVAL,
+		Type:        SETTING_TYPE_INT,
+		Unit:        "seconds",
+		Min:         5,
+		Max:         240,
+		Default:     "60",
+		Description: "How often the base station should report in, if it speaks the JSON control protocol",
+	},
+	{
+		Key:         SETTING_PRIMARY_NODE,
+		Type:        SETTING_TYPE_INT,
+		Min:         0,
+		Max:         255,
+		Description: "ID of the node whose temperature controls the furnace",
+	},
+	{
+		Key:         SETTING_GUEST_MODE,
+		Type:        SETTING_TYPE_BOOL,
+		Default:     "0",
+		Description: "Count recently seen unknown devices as somebody being home",
+	},
+	{
+		Key:         SETTING_OVERRIDE,
+		Type:        SETTING_TYPE_INT,
+		Unit:        "unix time",
+		Min:         0,
+		Default:     "0",
+		Description: "Time at which the heating override was last turned on",
+		Internal:    true,
+	},
+	{
+		Key:         SETTING_FURNACE_ON,
+		Type:        SETTING_TYPE_BOOL,
+		Default:     "0",
+		Description: "Whether the furnace was last told to turn on",
+		Internal:    true,
+	},
+}
+
+var ErrSettingUnset = errors.New("Setting has no value and no default")
+var ErrSetpointsCrossed = errors.New("The unoccupied temperature can't be above the occupied temperature")
+
+// Actor recorded for state written back after a database outage
+const CACHE_ACTOR = "cache"
+
+func lookupSetting(key string) (*SettingDef, error) {
+	for _, def := range SETTINGS_REGISTRY {
+		if def.Key == key {
+			return def, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown setting '%s'", key)
+}
+
+func (s *SettingDef) checkRange(v float64) error {
+	if v < s.Min {
+		return fmt.Errorf("%s must be at least %v", s.Key, s.Min)
+	}
+	if s.Max > s.Min && v > s.Max {
+		return fmt.Errorf("%s must be at most %v", s.Key, s.Max)
+	}
+	return nil
+}
+
+// Check that a value is acceptable for this setting, and return it in the
+// canonical form it is stored as.
+func (s *SettingDef) Validate(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch s.Type {
+	case SETTING_TYPE_FLOAT:
+		fv, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s must be a number", s.Key)
+		}
+		if err := s.checkRange(fv); err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(fv, 'f', -1, 64), nil
+	case SETTING_TYPE_INT:
+		iv, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s must be a whole number", s.Key)
+		}
+		if err := s.checkRange(float64(iv)); err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(iv, 10), nil
+	case SETTING_TYPE_BOOL:
+		switch strings.ToLower(value) {
+		case "1", "true", "on", "yes":
+			return "1", nil
+		case "0", "false", "off", "no":
+			return "0", nil
+		}
+		return "", fmt.Errorf("%s must be on or off", s.Key)
+	}
+	return "", fmt.Errorf("%s has unknown type %s", s.Key, s.Type)
+}
+
+type SettingChange struct {
+	Time     time.Time
+	Key      string
+	OldValue sql.NullString
+	NewValue string
+	Actor    string
+}
+
+const SETTINGS_REFRESH_INTERVAL = 30 * time.Second
+const SETTINGS_DEFAULT_CACHE_PATH = "ernest_settings_cache.json"
+
+// Settings are served from an in-memory cache that is periodically refreshed
+// from the database and mirrored to a local file. If the database goes away,
+// the last known values keep being used and the store reports itself as
+// degraded until it can reach the database again.
+type SettingsStore struct {
+	db         *sql.DB
+	cache_path string
+
+	mutex        sync.RWMutex
+	cache        map[string]string
+	dirty        map[string]bool
+	degraded     bool
+	last_error   error
+	last_refresh time.Time
+	watchers     []func(key, value string)
+
+	// Who made each change still waiting to be written
+	dirty_actors map[string]string
+	// Bumped on every local change, so a refresh can tell which keys changed
+	// after it read the database
+	generation uint64
+	changed    map[string]uint64
+	flush      chan bool
+	// Corrupt stored values that have been logged, so each is logged once
+	bad_values map[string]string
+}
+
+type settingsCacheFile struct {
+	Values    map[string]string
+	Dirty     []string
+	Refreshed time.Time
+}
+
+func NewSettingsStore(c *Config, db *sql.DB) *SettingsStore {
+	t := new(SettingsStore)
+	t.db = db
+	t.cache = make(map[string]string)
+	t.dirty = make(map[string]bool)
+	t.dirty_actors = make(map[string]string)
+	t.changed = make(map[string]uint64)
+	t.flush = make(chan bool, 1)
+	t.bad_values = make(map[string]string)
+
+	t.cache_path = c.State.SettingsCache
+	if t.cache_path == "" {
+		t.cache_path = SETTINGS_DEFAULT_CACHE_PATH
+	}
+	if err := t.loadCache(); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+
+	if err := t.Refresh(); err != nil {
+		log.Println(err)
+	}
+	return t
+}
+
+func (t *SettingsStore) Run() {
+	ticker := time.NewTicker(SETTINGS_REFRESH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.flush:
+			if err := t.writeDirty(); err != nil {
+				log.Println(err)
+			}
+			if err := t.saveCache(); err != nil {
+				log.Println(err)
+			}
+		case <-ticker.C:
+			if err := t.Refresh(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+type SettingsHealth struct {
+	Degraded    bool      `json:"degraded"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastRefresh time.Time `json:"last_refresh"`
+}
+
+// Whether the database is currently unreachable, and why
+func (t *SettingsStore) Health() *SettingsHealth {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	health := new(SettingsHealth)
+	health.Degraded = t.degraded
+	if t.last_error != nil {
+		health.LastError = t.last_error.Error()
+	}
+	health.LastRefresh = t.last_refresh
+	return health
+}
+
+func (t *SettingsStore) markDegraded(err error) {
+	metrics.CountDbError(DB_COMPONENT_SETTINGS)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.degraded = true
+	t.last_error = err
+}
+
+// Write internal state that hasn't reached the database yet
+func (t *SettingsStore) writeDirty() error {
+	t.mutex.RLock()
+	dirty := make(map[string]string)
+	actors := make(map[string]string)
+	for key := range t.dirty {
+		dirty[key] = t.cache[key]
+		actors[key] = t.dirty_actors[key]
+		if actors[key] == "" {
+			actors[key] = CACHE_ACTOR
+		}
+	}
+	t.mutex.RUnlock()
+
+	for key, value := range dirty {
+		if err := t.store(key, value, actors[key]); err != nil {
+			t.markDegraded(err)
+			return err
+		}
+		t.mutex.Lock()
+		if t.cache[key] == value {
+			delete(t.dirty, key)
+			delete(t.dirty_actors, key)
+		}
+		t.mutex.Unlock()
+	}
+	return nil
+}
+
+// Push any state changed during an outage back to the database, then reload
+// all settings from it.
+func (t *SettingsStore) Refresh() error {
+	if err := t.writeDirty(); err != nil {
+		return err
+	}
+
+	// Anything changed locally after this point is newer than what we read
+	t.mutex.RLock()
+	started := t.generation
+	t.mutex.RUnlock()
+
+	rows, err := t.db.Query("SELECT `key`, `value` FROM `settings`")
+	if err != nil {
+		t.markDegraded(err)
+		return err
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			t.markDegraded(err)
+			return err
+		}
+		values[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		t.markDegraded(err)
+		return err
+	}
+
+	t.mutex.Lock()
+	for key := range t.cache {
+		if !t.dirty[key] && t.changed[key] <= started {
+			delete(t.cache, key)
+		}
+	}
+	for key, value := range values {
+		if !t.dirty[key] && t.changed[key] <= started {
+			t.cache[key] = value
+		}
+	}
+	t.degraded = false
+	t.last_error = nil
+	t.last_refresh = time.Now()
+	t.mutex.Unlock()
+
+	return t.saveCache()
+}
+
+func (t *SettingsStore) loadCache() error {
+	data, err := ioutil.ReadFile(t.cache_path)
+	if err != nil {
+		return err
+	}
+	cached := new(settingsCacheFile)
+	if err := json.Unmarshal(data, cached); err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for key, value := range cached.Values {
+		t.cache[key] = value
+	}
+	for _, key := range cached.Dirty {
+		t.dirty[key] = true
+	}
+	t.last_refresh = cached.Refreshed
+	return nil
+}
+
+func (t *SettingsStore) saveCache() error {
+	t.mutex.RLock()
+	cached := new(settingsCacheFile)
+	cached.Values = make(map[string]string)
+	for key, value := range t.cache {
+		cached.Values[key] = value
+	}
+	for key := range t.dirty {
+		cached.Dirty = append(cached.Dirty, key)
+	}
+	cached.Refreshed = t.last_refresh
+	t.mutex.RUnlock()
+
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	tmp_path := t.cache_path + ".tmp"
+	if err := ioutil.WriteFile(tmp_path, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp_path, t.cache_path)
+}
+
+// Fetch the raw value of a setting, falling back to the registry default if
+// it has never been set.
+func (t *SettingsStore) Get(key string) (string, error) {
+	def, err := lookupSetting(key)
+	if err != nil {
+		return "", err
+	}
+
+	t.mutex.RLock()
+	value, ok := t.cache[key]
+	t.mutex.RUnlock()
+	if ok {
+		return value, nil
+	}
+	if def.Default == "" {
+		return "", ErrSettingUnset
+	}
+	return def.Default, nil
+}
+
+// Parse a stored value, falling back to the default if it is corrupt. The
+// fallback isn't an error, but is logged the first time it happens.
+func (t *SettingsStore) getParsed(key string, parse func(string) error) error {
+	value, err := t.Get(key)
+	if err != nil {
+		return err
+	}
+	if perr := parse(value); perr != nil {
+		def, _ := lookupSetting(key)
+		if def.Default == "" || parse(def.Default) != nil {
+			return perr
+		}
+		t.mutex.Lock()
+		logged := t.bad_values[key] == value
+		t.bad_values[key] = value
+		t.mutex.Unlock()
+		if !logged {
+			log.Printf("Bad stored value '%s' for %s, using the default '%s'", value, key, def.Default)
+		}
+	}
+	return nil
+}
+
+func (t *SettingsStore) GetFloat(key string) (float64, error) {
+	var fv float64
+	err := t.getParsed(key, func(v string) (perr error) {
+		fv, perr = strconv.ParseFloat(v, 64)
+		return
+	})
+	return fv, err
+}
+
+func (t *SettingsStore) GetInt(key string) (int64, error) {
+	var iv int64
+	err := t.getParsed(key, func(v string) (perr error) {
+		iv, perr = strconv.ParseInt(v, 10, 64)
+		return
+	})
+	return iv, err
+}
+
+func (t *SettingsStore) GetBool(key string) (bool, error) {
+	var bv bool
+	err := t.getParsed(key, func(v string) (perr error) {
+		bv, perr = strconv.ParseBool(v)
+		return
+	})
+	return bv, err
+}
+
+// Validate and store a new value for a setting. If the value changed, the
+// change is recorded in the history along with who made it.
+//
+// Internal state is updated in the cache straight away and written to the
+// database in the background, so the base station is never kept waiting on
+// it. User settings are only accepted if they can be saved to the database.
+func (t *SettingsStore) Set(key, value, actor string) error {
+	return t.SetMany(map[string]string{key: value}, actor)
+}
+
+// Validate several new values together, then store them. Nothing is stored
+// unless they all make sense, both alone and with each other.
+func (t *SettingsStore) SetMany(values map[string]string, actor string) error {
+	defs := make(map[string]*SettingDef)
+	validated := make(map[string]string)
+	for key, value := range values {
+		def, err := lookupSetting(key)
+		if err != nil {
+			return err
+		}
+		validated[key], err = def.Validate(value)
+		if err != nil {
+			return err
+		}
+		defs[key] = def
+	}
+	if err := t.checkCombination(validated); err != nil {
+		return err
+	}
+
+	// In registry order, so the history reads the same way as the form
+	for _, def := range SETTINGS_REGISTRY {
+		if value, ok := validated[def.Key]; ok {
+			if err := t.set(defs[def.Key], value, actor); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check the settings that depend on each other, with the given changes made
+func (t *SettingsStore) checkCombination(changes map[string]string) error {
+	_, idle_changed := changes[SETTING_IDLE_TEMP]
+	_, active_changed := changes[SETTING_ACTIVE_TEMP]
+	if !idle_changed && !active_changed {
+		return nil
+	}
+	value := func(key string) string {
+		if v, ok := changes[key]; ok {
+			return v
+		}
+		v, _ := t.Get(key)
+		return v
+	}
+	idle, idle_err := strconv.ParseFloat(value(SETTING_IDLE_TEMP), 64)
+	active, active_err := strconv.ParseFloat(value(SETTING_ACTIVE_TEMP), 64)
+	if idle_err == nil && active_err == nil && idle > active {
+		return ErrSetpointsCrossed
+	}
+	return nil
+}
+
+// Store an already validated value
+func (t *SettingsStore) set(def *SettingDef, value, actor string) error {
+	key := def.Key
+	if !def.Internal {
+		if err := t.store(key, value, actor); err != nil {
+			t.markDegraded(err)
+			return err
+		}
+	}
+
+	t.mutex.Lock()
+	old_value, ok := t.cache[key]
+	if !ok {
+		old_value = def.Default
+	}
+	changed := value != old_value || !ok
+	t.cache[key] = value
+	if def.Internal && changed {
+		t.dirty[key] = true
+		t.dirty_actors[key] = actor
+	} else if !def.Internal {
+		delete(t.dirty, key)
+		delete(t.dirty_actors, key)
+	}
+	t.generation++
+	t.changed[key] = t.generation
+	watchers := t.watchers
+	t.mutex.Unlock()
+
+	if def.Internal {
+		if changed {
+			select {
+			case t.flush <- true:
+			default:
+			}
+		}
+	} else if serr := t.saveCache(); serr != nil {
+		log.Println(serr)
+	}
+	if value != old_value {
+		for _, watcher := range watchers {
+			watcher(key, value)
+		}
+	}
+	return nil
+}
+
+// Call a function whenever a setting is changed through this store
+func (t *SettingsStore) Watch(watcher func(key, value string)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.watchers = append(t.watchers, watcher)
+}
+
+// Write a validated value to the database
+func (t *SettingsStore) store(key, value, actor string) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var old_value sql.NullString
+	row := tx.QueryRow("SELECT `value` FROM `settings` WHERE `key` = ? FOR UPDATE", key)
+	if err := row.Scan(&old_value); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if old_value.Valid && old_value.String == value {
+		return nil
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO settings (`key`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `value` = ?",
+		key, value, value,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO settings_history (`timestamp`, `key`, `old_value`, `new_value`, `actor`) VALUES (CURRENT_TIMESTAMP, ?, ?, ?, ?)",
+		key, old_value, value, actor,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (t *SettingsStore) SetFloat(key string, value float64, actor string) error {
+	return t.Set(key, strconv.FormatFloat(value, 'f', -1, 64), actor)
+}
+
+func (t *SettingsStore) SetInt(key string, value int64, actor string) error {
+	return t.Set(key, strconv.FormatInt(value, 10), actor)
+}
+
+func (t *SettingsStore) SetBool(key string, value bool, actor string) error {
+	return t.Set(key, strconv.FormatBool(value), actor)
+}
+
+func (t *SettingsStore) History(limit int) ([]*SettingChange, error) {
+	rows, err := t.db.Query(
+		"SELECT `timestamp`, `key`, `old_value`, `new_value`, `actor` FROM `settings_history` ORDER BY `id` DESC LIMIT ?",
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]*SettingChange, 0)
+	for rows.Next() {
+		c := new(SettingChange)
+		if err := rows.Scan(
+			&c.Time,
+			&c.Key,
+			&c.OldValue,
+			&c.NewValue,
+			&c.Actor,
+		); err != nil {
+			continue
+		}
+		history = append(history, c)
+	}
+	return history, nil
+}
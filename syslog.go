@@ -0,0 +1,208 @@
+/*
+Syslog parser
+
+Understands both BSD style (RFC 3164) lines, as written to /var/log/syslog or
+sent over the network with a priority prefix, and RFC 5424 messages. Lines
+that don't fit either format are rejected rather than guessed at.
+*/
+
+package main
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ErrMalformedSyslog = errors.New("Malformed syslog line")
+
+const RFC3164_TIMESTAMP = "Jan _2 15:04:05"
+
+type SyslogLine struct {
+	Priority  int
+	Timestamp time.Time
+	Host      string
+	Program   string
+	Pid       string
+	Message   string
+}
+
+// Parse a syslog line. Timestamps without a timezone or year are taken to be
+// in loc, in the year leading up to now.
+func parseSyslogLine(line string, loc *time.Location, now time.Time) (*SyslogLine, error) {
+	l := new(SyslogLine)
+	l.Priority = -1
+	rest := strings.TrimRightFunc(line, unicode.IsSpace)
+
+	// Lines received over the network start with a priority
+	if strings.HasPrefix(rest, "<") {
+		end := strings.IndexByte(rest, '>')
+		if end < 2 || end > 4 {
+			return nil, ErrMalformedSyslog
+		}
+		pri, err := strconv.Atoi(rest[1:end])
+		if err != nil || pri > 191 {
+			return nil, ErrMalformedSyslog
+		}
+		l.Priority = pri
+		rest = rest[end+1:]
+
+		// RFC 5424 has a version number straight after the priority
+		if strings.HasPrefix(rest, "1 ") {
+			return parseRfc5424(l, rest[2:], now)
+		}
+	}
+	return parseRfc3164(l, rest, loc, now)
+}
+
+// Split off the next space separated field
+func nextSyslogField(s string) (string, string) {
+	s = strings.TrimLeft(s, " ")
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+func parseRfc3164(l *SyslogLine, rest string, loc *time.Location, now time.Time) (*SyslogLine, error) {
+	rest = strings.TrimLeft(rest, " ")
+
+	// Either the traditional "Mmm dd hh:mm:ss", or RFC 3339 as written by
+	// rsyslog's high precision file format
+	if len(rest) >= len(RFC3164_TIMESTAMP) {
+		ts, err := time.ParseInLocation(RFC3164_TIMESTAMP, rest[:len(RFC3164_TIMESTAMP)], loc)
+		if err == nil {
+			// There's no year, so pick the one that puts this line in the
+			// past, allowing a little slack for clock skew.
+			ts = ts.AddDate(now.In(loc).Year(), 0, 0)
+			if ts.After(now.Add(time.Hour * 24)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			l.Timestamp = ts
+			rest = rest[len(RFC3164_TIMESTAMP):]
+		}
+	}
+	if l.Timestamp.IsZero() {
+		var field string
+		field, rest = nextSyslogField(rest)
+		ts, err := time.Parse(time.RFC3339Nano, field)
+		if err != nil {
+			return nil, ErrMalformedSyslog
+		}
+		l.Timestamp = ts
+	}
+
+	l.Host, rest = nextSyslogField(rest)
+	if l.Host == "" {
+		return nil, ErrMalformedSyslog
+	}
+
+	// The tag is optional, but if present looks like "program[pid]:"
+	tag, message := nextSyslogField(rest)
+	if strings.HasSuffix(tag, ":") {
+		l.Program, l.Pid = splitSyslogTag(strings.TrimSuffix(tag, ":"))
+		rest = message
+	}
+	l.Message = strings.TrimLeft(rest, " ")
+	return l, nil
+}
+
+func splitSyslogTag(tag string) (string, string) {
+	open := strings.IndexByte(tag, '[')
+	if open > 0 && strings.HasSuffix(tag, "]") {
+		return tag[:open], tag[open+1 : len(tag)-1]
+	}
+	return tag, ""
+}
+
+func parseRfc5424(l *SyslogLine, rest string, now time.Time) (*SyslogLine, error) {
+	var timestamp, app_name, proc_id, msg_id string
+	timestamp, rest = nextSyslogField(rest)
+	l.Host, rest = nextSyslogField(rest)
+	app_name, rest = nextSyslogField(rest)
+	proc_id, rest = nextSyslogField(rest)
+	msg_id, rest = nextSyslogField(rest)
+	if timestamp == "" || l.Host == "" || app_name == "" || proc_id == "" || msg_id == "" {
+		return nil, ErrMalformedSyslog
+	}
+
+	if timestamp == "-" {
+		l.Timestamp = now
+	} else {
+		ts, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return nil, ErrMalformedSyslog
+		}
+		l.Timestamp = ts
+	}
+	if l.Host == "-" {
+		l.Host = ""
+	}
+	if app_name != "-" {
+		l.Program = app_name
+	}
+	if proc_id != "-" {
+		l.Pid = proc_id
+	}
+
+	// Skip over the structured data, which is either a nil value or a run of
+	// bracketed elements that may contain quoted, escaped brackets.
+	rest = strings.TrimLeft(rest, " ")
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else if strings.HasPrefix(rest, "[") {
+		end, ok := structuredDataEnd(rest)
+		if !ok {
+			return nil, ErrMalformedSyslog
+		}
+		rest = rest[end:]
+	} else {
+		return nil, ErrMalformedSyslog
+	}
+
+	rest = strings.TrimPrefix(rest, " ")
+	l.Message = strings.TrimPrefix(rest, "\xEF\xBB\xBF")
+	return l, nil
+}
+
+// Find the index just past the last structured data element
+func structuredDataEnd(s string) (int, bool) {
+	in_element := false
+	in_quotes := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case in_quotes && c == '\\':
+			i++
+		case in_quotes:
+			in_quotes = c != '"'
+		case in_element && c == '"':
+			in_quotes = true
+		case in_element && c == ']':
+			in_element = false
+		case in_element:
+		case c == '[':
+			in_element = true
+		default:
+			return i, true
+		}
+	}
+	if in_element {
+		return 0, false
+	}
+	return len(s), true
+}
+
+// Whether a program name matches any of the given glob patterns
+func matchesProgram(patterns []string, program string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, program); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+/*
+Syslog receiver
+
+Accepts syslog messages over UDP and TCP, so that presence can be picked up
+from a DHCP server running on another machine. Received messages go through
+the same matching as lines tailed from the local syslog.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PRESENCE_DEFAULT_LISTEN_PORT = "514"
+
+// Largest message we'll accept, from RFC 5425's recommended minimum
+const SYSLOG_MAX_MESSAGE = 8192
+
+// Senders keep a TCP connection open, but there should only ever be a few
+const SYSLOG_MAX_CONNECTIONS = 16
+
+// Connections that go quiet for this long are dropped, freeing their slot
+const SYSLOG_IDLE_TIMEOUT = 15 * time.Minute
+
+type SyslogListenerSource struct {
+	address string
+	// Only set when no allow-list was configured at all
+	allow_all bool
+	allowed   []*net.IPNet
+	matcher   *SyslogMatcher
+}
+
+func NewSyslogListenerSource(address string, allow []string, programs []string) *SyslogListenerSource {
+	t := new(SyslogListenerSource)
+	t.address = address
+	t.matcher = NewSyslogMatcher(programs, t.Name())
+
+	for _, entry := range allow {
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Println("Ignoring bad syslog allow entry", entry, err)
+			continue
+		}
+		t.allowed = append(t.allowed, network)
+	}
+	if len(allow) == 0 {
+		log.Println("No syslog senders allow-listed, accepting messages from anyone")
+		t.allow_all = true
+	} else if len(t.allowed) == 0 {
+		// Don't let a typo open the listener up to everybody
+		log.Fatal("None of the syslog allow entries could be parsed: ", strings.Join(allow, ", "))
+	}
+
+	return t
+}
+
+func (t *SyslogListenerSource) Name() string {
+	return PRESENCE_SOURCE_SYSLOG_LISTENER
+}
+
+// Whether messages from a sender should be accepted
+func (t *SyslogListenerSource) isAllowed(addr net.Addr) bool {
+	if t.allow_all {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	for _, network := range t.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SyslogListenerSource) Run(observations chan<- *PresenceObservation) error {
+	udp, err := net.ListenPacket("udp", t.address)
+	if err != nil {
+		return err
+	}
+	defer udp.Close()
+
+	tcp, err := net.Listen("tcp", t.address)
+	if err != nil {
+		return err
+	}
+	defer tcp.Close()
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- t.serveUdp(udp, observations)
+	}()
+	go func() {
+		errs <- t.serveTcp(tcp, observations)
+	}()
+	return <-errs
+}
+
+// Each datagram holds a single message
+func (t *SyslogListenerSource) serveUdp(conn net.PacketConn, observations chan<- *PresenceObservation) error {
+	buf := make([]byte, SYSLOG_MAX_MESSAGE)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if !t.isAllowed(addr) {
+			continue
+		}
+		t.matcher.Match(strings.TrimRight(string(buf[:n]), "\r\n\x00"), observations)
+	}
+}
+
+func (t *SyslogListenerSource) serveTcp(listener net.Listener, observations chan<- *PresenceObservation) error {
+	slots := make(chan bool, SYSLOG_MAX_CONNECTIONS)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !t.isAllowed(conn.RemoteAddr()) {
+			log.Println("Rejecting syslog connection from", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		select {
+		case slots <- true:
+		default:
+			log.Println("Too many syslog connections, rejecting", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-slots }()
+			defer conn.Close()
+			err := t.readTcpMessages(conn, observations)
+			if err != nil && err != io.EOF {
+				log.Println("Syslog connection from", conn.RemoteAddr(), "closed:", err)
+			}
+		}()
+	}
+}
+
+// TCP syslog is framed either with a leading octet count, or by newlines
+// (RFC 6587). Senders may use either, so check each message. Neither kind of
+// message may be longer than SYSLOG_MAX_MESSAGE.
+func (t *SyslogListenerSource) readTcpMessages(conn net.Conn, observations chan<- *PresenceObservation) error {
+	reader := bufio.NewReaderSize(conn, SYSLOG_MAX_MESSAGE)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(SYSLOG_IDLE_TIMEOUT)); err != nil {
+			return err
+		}
+		first, err := reader.Peek(1)
+		if err != nil {
+			return err
+		}
+
+		var message string
+		if first[0] >= '1' && first[0] <= '9' {
+			length_b, err := reader.ReadSlice(' ')
+			if err != nil {
+				return err
+			}
+			length, err := strconv.Atoi(strings.TrimSuffix(string(length_b), " "))
+			if err != nil || length > SYSLOG_MAX_MESSAGE {
+				return errors.New("Bad syslog frame length")
+			}
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				return err
+			}
+			message = string(buf)
+		} else {
+			// ReadSlice gives up with bufio.ErrBufferFull on overlong lines
+			line, err := reader.ReadSlice('\n')
+			if err != nil && (err != io.EOF || len(line) == 0) {
+				return err
+			}
+			message = string(line)
+		}
+		t.matcher.Match(strings.TrimRight(message, "\r\n\x00"), observations)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSyslogLine(t *testing.T) {
+	loc := time.FixedZone("EST", -5*60*60)
+	now := time.Date(2016, time.January, 3, 12, 0, 0, 0, loc)
+
+	tests := []struct {
+		name string
+		line string
+		want *SyslogLine
+	}{
+		{
+			"file line",
+			"Jan  3 11:58:01 router dhcpd[1234]: DHCPACK on 10.0.0.5 to aa:bb:cc:dd:ee:ff via eth1",
+			&SyslogLine{-1, time.Date(2016, time.January, 3, 11, 58, 1, 0, loc),
+				"router", "dhcpd", "1234", "DHCPACK on 10.0.0.5 to aa:bb:cc:dd:ee:ff via eth1"},
+		},
+		{
+			"last year",
+			"Dec 31 23:59:59 router dhcpd: DHCPREQUEST",
+			&SyslogLine{-1, time.Date(2015, time.December, 31, 23, 59, 59, 0, loc),
+				"router", "dhcpd", "", "DHCPREQUEST"},
+		},
+		{
+			"a little in the future",
+			"Jan  3 18:00:00 router dhcpd: DHCPREQUEST",
+			&SyslogLine{-1, time.Date(2016, time.January, 3, 18, 0, 0, 0, loc),
+				"router", "dhcpd", "", "DHCPREQUEST"},
+		},
+		{
+			"no tag",
+			"Jan  3 11:58:01 router just a message",
+			&SyslogLine{-1, time.Date(2016, time.January, 3, 11, 58, 1, 0, loc),
+				"router", "", "", "just a message"},
+		},
+		{
+			"trailing whitespace",
+			"Jan  3 11:58:01 router dhcpd: DHCPACK\r\n",
+			&SyslogLine{-1, time.Date(2016, time.January, 3, 11, 58, 1, 0, loc),
+				"router", "dhcpd", "", "DHCPACK"},
+		},
+		{
+			"high precision file line",
+			"2016-01-03T11:58:01.123456-05:00 router dnsmasq-dhcp[99]: DHCPACK(br0) 10.0.0.5 aa:bb:cc:dd:ee:ff phone",
+			&SyslogLine{-1, time.Date(2016, time.January, 3, 11, 58, 1, 123456000, loc),
+				"router", "dnsmasq-dhcp", "99", "DHCPACK(br0) 10.0.0.5 aa:bb:cc:dd:ee:ff phone"},
+		},
+		{
+			"network RFC 3164",
+			"<30>Jan  3 11:58:01 router dhcpd[1234]: DHCPACK",
+			&SyslogLine{30, time.Date(2016, time.January, 3, 11, 58, 1, 0, loc),
+				"router", "dhcpd", "1234", "DHCPACK"},
+		},
+		{
+			"RFC 5424",
+			"<30>1 2016-01-03T16:58:01.5Z router dhcpd 1234 - - DHCPACK on 10.0.0.5",
+			&SyslogLine{30, time.Date(2016, time.January, 3, 16, 58, 1, 500000000, time.UTC),
+				"router", "dhcpd", "1234", "DHCPACK on 10.0.0.5"},
+		},
+		{
+			"RFC 5424 nil values",
+			"<30>1 - - - - - -",
+			&SyslogLine{30, now, "", "", "", ""},
+		},
+		{
+			"RFC 5424 structured data",
+			`<165>1 2016-01-03T16:58:01Z router dhcpd - ID47 [a@1 b="c\"]"][d@1 e="f"] DHCPACK`,
+			&SyslogLine{165, time.Date(2016, time.January, 3, 16, 58, 1, 0, time.UTC),
+				"router", "dhcpd", "", "DHCPACK"},
+		},
+		{
+			"RFC 5424 byte order mark",
+			"<30>1 2016-01-03T16:58:01Z router dhcpd - - - \xEF\xBB\xBFDHCPACK",
+			&SyslogLine{30, time.Date(2016, time.January, 3, 16, 58, 1, 0, time.UTC),
+				"router", "dhcpd", "", "DHCPACK"},
+		},
+		{"empty", "", nil},
+		{"garbage", "not a syslog line", nil},
+		{"no host", "Jan  3 11:58:01 ", nil},
+		{"unterminated priority", "<30 Jan  3 11:58:01 router x: y", nil},
+		{"priority out of range", "<192>Jan  3 11:58:01 router x: y", nil},
+		{"non-numeric priority", "<ab>Jan  3 11:58:01 router x: y", nil},
+		{"RFC 5424 missing fields", "<30>1 2016-01-03T16:58:01Z router dhcpd", nil},
+		{"RFC 5424 bad timestamp", "<30>1 yesterday router dhcpd - - - x", nil},
+		{"RFC 5424 unterminated structured data", `<30>1 - router dhcpd - - [a@1 b="c"`, nil},
+		{"RFC 5424 bad structured data", "<30>1 - router dhcpd - - x", nil},
+	}
+
+	for _, test := range tests {
+		got, err := parseSyslogLine(test.line, loc, now)
+		if test.want == nil {
+			if err != ErrMalformedSyslog {
+				t.Errorf("%s: got %+v, %v, want ErrMalformedSyslog", test.name, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !got.Timestamp.Equal(test.want.Timestamp) {
+			t.Errorf("%s: timestamp %v, want %v", test.name, got.Timestamp, test.want.Timestamp)
+		}
+		got.Timestamp = test.want.Timestamp
+		if *got != *test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMatchesProgram(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		program  string
+		want     bool
+	}{
+		{[]string{"dhcpd"}, "dhcpd", true},
+		{[]string{"dhcpd"}, "dhcpd6", false},
+		{[]string{"dnsmasq*"}, "dnsmasq-dhcp", true},
+		{[]string{"dhcpd", "dnsmasq*"}, "dnsmasq", true},
+		{nil, "dhcpd", false},
+	}
+	for _, test := range tests {
+		if got := matchesProgram(test.patterns, test.program); got != test.want {
+			t.Errorf("matchesProgram(%v, %q) = %v, want %v", test.patterns, test.program, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const ANALYTICS_PLOT_DIR = "/var/www/nest/"
+const ANALYTICS_PLOT_INTERVAL = 15 * time.Minute
+
+// Periods linked from the analytics page, in days. Each gets its own plot.
+var ANALYTICS_PLOT_DAYS = []int{7, 28, 365}
+
+type AnalyticsInfo struct {
+	Days     int
+	People   []*PresenceAnalytics
+	Weekdays []string
+	// Plot for this period, if there is one
+	Plot string
+}
+
+func analyticsPlotName(days int) string {
+	return fmt.Sprintf("graph_presence_%dd.png", days)
+}
+
+// Regenerates the presence plots every so often, rather than on each page
+// load, so that loads don't race to write the same file
+func (t *WebServer) presencePlotter() {
+	for {
+		for _, days := range ANALYTICS_PLOT_DAYS {
+			analytics := t.decider.getAllPresenceAnalytics(time.Duration(days) * 24 * time.Hour)
+			if err := generatePresencePlot(analytics, ANALYTICS_PLOT_DIR+analyticsPlotName(days)); err != nil {
+				log.Println(err)
+			}
+		}
+		time.Sleep(ANALYTICS_PLOT_INTERVAL)
+	}
+}
+
+// Period asked for with ?days=, within reason
+func analyticsPeriod(r *http.Request) time.Duration {
+	days, err := strconv.Atoi(r.Form.Get("days"))
+	if err != nil || days <= 0 {
+		return ANALYTICS_DEFAULT_PERIOD
+	}
+	period := time.Duration(days) * 24 * time.Hour
+	if period > ANALYTICS_MAX_PERIOD {
+		return ANALYTICS_MAX_PERIOD
+	}
+	return period
+}
+
+// Shows when each housemate tends to come and go
+func (t *WebServer) AnalyticsPage(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	period := analyticsPeriod(r)
+	template_data := new(AnalyticsInfo)
+	template_data.Days = int(period.Hours() / 24)
+	template_data.People = t.decider.getAllPresenceAnalytics(period)
+	template_data.Weekdays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+	for _, days := range ANALYTICS_PLOT_DAYS {
+		if days == template_data.Days {
+			template_data.Plot = analyticsPlotName(days)
+		}
+	}
+
+	template, err := t.parseTemplate(r, t.config.Templates.Analytics)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+
+	err = template.Execute(w, template_data)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+}
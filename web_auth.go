@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const SESSION_COOKIE = "ernest_session"
+
+// Forms carry the CSRF token in this field, scripts using a session cookie in
+// the header
+const CSRF_FIELD = "csrf_token"
+const CSRF_HEADER = "X-CSRF-Token"
+
+type authContextKey struct{}
+
+// Who made a request, and how
+type RequestAuth struct {
+	User *User
+	// Nil if authenticated with an API token
+	Session *Session
+}
+
+// The authentication attached to a request by protect, if any
+func requestAuth(r *http.Request) *RequestAuth {
+	auth, _ := r.Context().Value(authContextKey{}).(*RequestAuth)
+	return auth
+}
+
+func requestUser(r *http.Request) *User {
+	if auth := requestAuth(r); auth != nil {
+		return auth.User
+	}
+	return nil
+}
+
+// Work out who's making a request from its bearer token or session cookie
+func (t *WebServer) authenticate(r *http.Request) (*RequestAuth, error) {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		user, err := t.auth.LookupApiToken(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+		if err != nil || user == nil {
+			return nil, err
+		}
+		return &RequestAuth{User: user}, nil
+	}
+
+	cookie, err := r.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return nil, nil
+	}
+	session, err := t.auth.LookupSession(cookie.Value)
+	if err != nil || session == nil {
+		return nil, err
+	}
+	return &RequestAuth{User: session.User, Session: session}, nil
+}
+
+func isApiRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, API_PREFIX)
+}
+
+// Only a local path is safe to redirect to after logging in
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func checkCsrf(r *http.Request, session *Session) bool {
+	token := r.Header.Get(CSRF_HEADER)
+	if token == "" {
+		token = r.PostFormValue(CSRF_FIELD)
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(session.Csrf)) == 1
+}
+
+// Wrap a servlet so it needs a logged in user. Reads need read permission, and
+// anything else needs the given permission and, for browsers, a CSRF token.
+func (t *WebServer) protect(servlet func(http.ResponseWriter, *http.Request), write Permission) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth, err := t.authenticate(r)
+		if err != nil {
+			log.Println(err)
+			if isApiRequest(r) {
+				writeJsonError(w, http.StatusServiceUnavailable, "unavailable", "Can't check credentials")
+			} else {
+				http.Error(w, "Can't check credentials", http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		if auth == nil {
+			if isApiRequest(r) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="ernest"`)
+				writeJsonError(w, http.StatusUnauthorized, "unauthorized", "Log in or use an API token")
+				return
+			}
+			// Scrapers and scripts get a 401 rather than a login form
+			if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="ernest"`)
+				http.Error(w, "Log in or use an API token", http.StatusUnauthorized)
+				return
+			}
+			next := "/"
+			if r.Method == "GET" {
+				next = r.URL.RequestURI()
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+			return
+		}
+
+		needed := PERMISSION_READ
+		if r.Method != "GET" && r.Method != "HEAD" {
+			needed = write
+			if auth.Session != nil && !checkCsrf(r, auth.Session) {
+				if isApiRequest(r) {
+					writeJsonError(w, http.StatusForbidden, "csrf", "Missing or wrong "+CSRF_HEADER+" header")
+				} else {
+					http.Error(w, "Form expired, go back and try again", http.StatusForbidden)
+				}
+				return
+			}
+		}
+		if auth.User.Permission() < needed {
+			if isApiRequest(r) {
+				writeJsonError(w, http.StatusForbidden, "forbidden", "You can only look, not change things")
+			} else {
+				http.Error(w, "You can only look, not change things", http.StatusForbidden)
+			}
+			return
+		}
+
+		if info := requestInfo(r); info != nil {
+			info.User = auth.User.Username
+		}
+		servlet(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, auth)))
+	}
+}
+
+type LoginInfo struct {
+	Next     string
+	Username string
+	Error    string
+}
+
+func (t *WebServer) setSessionCookie(w http.ResponseWriter, session *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    session.token,
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   t.config.Auth.SecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (t *WebServer) LoginPage(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	template_data := new(LoginInfo)
+	template_data.Next = safeNext(r.Form.Get("next"))
+
+	if r.Method == "POST" {
+		template_data.Username = r.PostForm.Get("username")
+		user, err := t.auth.Authenticate(template_data.Username, r.PostForm.Get("password"))
+		var session *Session
+		if err == nil {
+			session, err = t.auth.CreateSession(user)
+		}
+		if err == nil {
+			t.setSessionCookie(w, session)
+			http.Redirect(w, r, template_data.Next, http.StatusSeeOther)
+			return
+		}
+		if err != errBadLogin {
+			log.Println(err)
+		}
+		template_data.Error = err.Error()
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	template, err := t.parseTemplate(r, t.config.Templates.Login)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+
+	err = template.Execute(w, template_data)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+}
+
+func (t *WebServer) LogoutPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if auth := requestAuth(r); auth != nil && auth.Session != nil {
+		if cookie, err := r.Cookie(SESSION_COOKIE); err == nil {
+			if err := t.auth.DeleteSession(cookie.Value); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+type AccountInfo struct {
+	User      *User
+	Tokens    []*ApiToken
+	Error     string
+	Saved     bool
+	NewToken  string
+	TokenName string
+}
+
+// Lets somebody change their password and manage their API tokens
+func (t *WebServer) AccountPage(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	template_data := new(AccountInfo)
+	template_data.User = requestUser(r)
+
+	if r.Method == "POST" {
+		var err error
+		switch r.PostForm.Get("action") {
+		case "change_password":
+			_, err = t.auth.Authenticate(template_data.User.Username, r.PostForm.Get("current_password"))
+			if err == errBadLogin {
+				err = errors.New("Your current password is wrong")
+			}
+			if err == nil && r.PostForm.Get("new_password") != r.PostForm.Get("confirm_password") {
+				err = errors.New("The new passwords don't match")
+			}
+			if err == nil {
+				err = t.auth.SetPassword(template_data.User.Id, r.PostForm.Get("new_password"))
+			}
+			// That signed everybody out, including us, so sign back in
+			var session *Session
+			if err == nil {
+				session, err = t.auth.CreateSession(template_data.User)
+			}
+			if err == nil {
+				t.setSessionCookie(w, session)
+			}
+		case "create_token":
+			template_data.TokenName = r.PostForm.Get("name")
+			template_data.NewToken, err = t.auth.CreateApiToken(template_data.User, template_data.TokenName)
+		case "revoke_token":
+			var id int64
+			id, err = strconv.ParseInt(r.PostForm.Get("id"), 10, 64)
+			if err == nil {
+				err = t.auth.RevokeApiToken(template_data.User, id)
+			}
+		default:
+			err = errors.New("Unknown action")
+		}
+		if err == nil && template_data.NewToken == "" {
+			http.Redirect(w, r, "/account?saved=1", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			template_data.Error = err.Error()
+		}
+	}
+	template_data.Saved = r.Form.Get("saved") == "1"
+
+	tokens, err := t.auth.ApiTokens(template_data.User)
+	if err != nil {
+		log.Println(err)
+	}
+	template_data.Tokens = tokens
+
+	template, err := t.parseTemplate(r, t.config.Templates.Account)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+
+	err = template.Execute(w, template_data)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type GuestsInfo struct {
+	GuestMode  bool
+	GuestsHome bool
+	Unknown    []*UnknownDevice
+	Ignored    []*UnknownDevice
+	People     []*Housemate
+	Error      string
+}
+
+// Lists unknown devices, and lets them be promoted to a housemate or ignored
+func (t *WebServer) GuestsPage(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	template_data := new(GuestsInfo)
+
+	if r.Method == "POST" {
+		mac := r.PostForm.Get("mac")
+		var err error
+		switch r.PostForm.Get("action") {
+		case "ignore":
+			err = t.dhcp_tailer.IgnoreUnknown(mac)
+		case "promote":
+			var person_id int64
+			if r.PostForm.Get("person") != "new" {
+				person_id, err = strconv.ParseInt(r.PostForm.Get("person"), 10, 64)
+			}
+			name := r.PostForm.Get("name")
+			if err == nil && person_id == 0 && name == "" {
+				err = errNameRequired
+			}
+			if err == nil {
+				err = t.dhcp_tailer.PromoteUnknown(mac, person_id, name, r.PostForm.Get("label"))
+			}
+		}
+		if err == nil {
+			http.Redirect(w, r, "/guests", http.StatusSeeOther)
+			return
+		}
+		log.Println(err)
+		template_data.Error = err.Error()
+	}
+
+	template_data.GuestMode = t.decider.getGuestMode()
+	template_data.GuestsHome = t.dhcp_tailer.GuestsHome()
+	for _, device := range t.dhcp_tailer.UnknownDevices() {
+		if device.Ignored {
+			template_data.Ignored = append(template_data.Ignored, device)
+		} else {
+			template_data.Unknown = append(template_data.Unknown, device)
+		}
+	}
+	template_data.People = t.dhcp_tailer.Snapshot().People
+
+	template, err := t.parseTemplate(r, t.config.Templates.Guests)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+
+	err = template.Execute(w, template_data)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type PeopleInfo struct {
+	People []*Housemate
+	// Shown once after being reset, since it can't be read back later
+	NewToken       string
+	NewTokenPerson string
+	Error          string
+}
+
+// Parse an optional number of seconds from a form field, blank meaning the
+// default
+func parseOptionalSeconds(value string) (sql.NullInt64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return sql.NullInt64{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return sql.NullInt64{}, errors.New("Timeouts must be a whole number of seconds")
+	}
+	return sql.NullInt64{Int64: seconds, Valid: true}, nil
+}
+
+// Form values for a housemate's timeouts, left blank when they use the
+// default so saving other changes doesn't pin the current default
+func (h *Housemate) AwayTimeoutField() string {
+	if !h.custom_away_timeout {
+		return ""
+	}
+	return strconv.FormatInt(int64(h.AwayTimeout.Seconds()), 10)
+}
+
+func (h *Housemate) DebounceField() string {
+	if !h.custom_debounce {
+		return ""
+	}
+	return strconv.FormatInt(int64(h.Debounce.Seconds()), 10)
+}
+
+func personFieldsFromForm(r *http.Request) (*PersonFields, error) {
+	var err error
+	p := new(PersonFields)
+	p.Name = r.PostForm.Get("name")
+	if p.AwayTimeout, err = parseOptionalSeconds(r.PostForm.Get("away_timeout")); err != nil {
+		return nil, err
+	}
+	if p.Debounce, err = parseOptionalSeconds(r.PostForm.Get("debounce")); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func deviceFieldsFromForm(r *http.Request) *DeviceFields {
+	d := new(DeviceFields)
+	d.Label = r.PostForm.Get("label")
+	d.Mac = r.PostForm.Get("mac")
+	d.Hostname = r.PostForm.Get("hostname")
+	d.ClientId = r.PostForm.Get("client_id")
+	d.CountsForPresence = r.PostForm.Get("counts_for_presence") != ""
+	return d
+}
+
+// Lists housemates and their devices, and lets them be added, edited and
+// removed without a restart
+func (t *WebServer) PeoplePage(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	template_data := new(PeopleInfo)
+
+	if r.Method == "POST" {
+		id, err := strconv.ParseInt(r.PostForm.Get("id"), 10, 64)
+		action := r.PostForm.Get("action")
+		if action == "add_person" {
+			err = nil
+		}
+		var p *PersonFields
+		if err == nil {
+			switch action {
+			case "add_person":
+				if p, err = personFieldsFromForm(r); err == nil {
+					_, err = t.dhcp_tailer.CreatePerson(p)
+				}
+			case "update_person":
+				if p, err = personFieldsFromForm(r); err == nil {
+					err = t.dhcp_tailer.UpdatePerson(id, p)
+				}
+			case "delete_person":
+				err = t.dhcp_tailer.DeletePerson(id)
+			case "reset_token":
+				template_data.NewToken, err = t.dhcp_tailer.ResetPresenceToken(id)
+				template_data.NewTokenPerson = r.PostForm.Get("name")
+			case "add_device":
+				_, err = t.dhcp_tailer.CreateDevice(id, deviceFieldsFromForm(r))
+			case "update_device":
+				err = t.dhcp_tailer.UpdateDevice(id, deviceFieldsFromForm(r))
+			case "delete_device":
+				err = t.dhcp_tailer.DeleteDevice(id)
+			default:
+				err = errors.New("Unknown action")
+			}
+		}
+		if err == nil && template_data.NewToken == "" {
+			http.Redirect(w, r, "/people", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			template_data.Error = err.Error()
+		}
+	}
+
+	template_data.People = t.dhcp_tailer.Snapshot().People
+
+	template, err := t.parseTemplate(r, t.config.Templates.People)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+
+	err = template.Execute(w, template_data)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type SettingRow struct {
+	Def *SettingDef
+	// Value, unit, range and default in the units being shown
+	Value   string
+	Unit    string
+	Min     string
+	Max     string
+	Default string
+	Error   string
+	// Nodes to choose from, for the primary node
+	Nodes []*ApiNode
+}
+
+type SettingsInfo struct {
+	Settings     []*SettingRow
+	History      []*SettingChange
+	Saved        bool
+	Fahrenheit   bool
+	PrimaryUnset bool
+	Error        string
+}
+
+// Temperature settings are stored in °C, but can be shown and entered in °F
+func isTemperatureSetting(def *SettingDef) bool {
+	return def.Unit == "°C"
+}
+
+func celsiusToFahrenheit(c float64) float64 {
+	return c*9.0/5.0 + 32.0
+}
+
+func fahrenheitToCelsius(f float64) float64 {
+	return (f - 32.0) * 5.0 / 9.0
+}
+
+func formatSettingNumber(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+// A stored value as it should be shown
+func displaySetting(def *SettingDef, value string, fahrenheit bool) string {
+	if !fahrenheit || !isTemperatureSetting(def) || value == "" {
+		return value
+	}
+	c, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	return formatSettingNumber(celsiusToFahrenheit(c))
+}
+
+// Validate an entered value, returning it in the form it's stored as
+func parseSetting(def *SettingDef, value string, fahrenheit bool) (string, error) {
+	if !fahrenheit || !isTemperatureSetting(def) {
+		return def.Validate(value)
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return "", fmt.Errorf("%s must be a number", def.Key)
+	}
+	// Keep enough places that the value shows back as it was entered, which
+	// 2 wouldn't: 65 °F would come back as 64.99 °F
+	stored, err := def.Validate(strconv.FormatFloat(fahrenheitToCelsius(f), 'f', 6, 64))
+	if err != nil {
+		// Report the range in the units it was entered in
+		return "", fmt.Errorf("%s must be between %s and %s °F", def.Key,
+			formatSettingNumber(celsiusToFahrenheit(def.Min)),
+			formatSettingNumber(celsiusToFahrenheit(def.Max)))
+	}
+	return stored, nil
+}
+
+func (t *WebServer) settingRow(def *SettingDef, value string, fahrenheit bool) *SettingRow {
+	row := &SettingRow{Def: def, Unit: def.Unit}
+	row.Value = displaySetting(def, value, fahrenheit)
+	row.Default = displaySetting(def, def.Default, fahrenheit)
+	row.Min = displaySetting(def, formatSettingNumber(def.Min), fahrenheit)
+	if def.Max > def.Min {
+		row.Max = displaySetting(def, formatSettingNumber(def.Max), fahrenheit)
+	}
+	if fahrenheit && isTemperatureSetting(def) {
+		row.Unit = "°F"
+	}
+
+	if def.Key == SETTING_PRIMARY_NODE {
+		nodes, err := t.decider.getNodes()
+		if err != nil {
+			log.Println(err)
+		}
+		// Keep the current choice even if it's gone quiet
+		found := value == ""
+		for _, node := range nodes {
+			found = found || strconv.FormatInt(node.Id, 10) == value
+		}
+		if id, err := strconv.ParseInt(value, 10, 64); err == nil && !found {
+			nodes = append(nodes, &ApiNode{Id: id, Name: fmt.Sprintf("Node %d", id)})
+		}
+		row.Nodes = nodes
+	}
+	return row
+}
+
+// Edits every user facing setting, with temperatures in °C or, with
+// ?unit=f, °F
+func (t *WebServer) SettingsPage(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	template_data := new(SettingsInfo)
+	template_data.Fahrenheit = r.Form.Get("unit") == "f"
+
+	// Check everything before saving anything, so a mistake in one field
+	// doesn't leave the others half applied
+	changes := make(map[string]string)
+	stored := make(map[string]string)
+	failed := false
+	for _, def := range SETTINGS_REGISTRY {
+		value, err := t.decider.settings.Get(def.Key)
+		if err != nil && err != ErrSettingUnset {
+			log.Println(err)
+		}
+		stored[def.Key] = value
+		row := t.settingRow(def, value, template_data.Fahrenheit)
+
+		if r.Method == "POST" && !def.Internal {
+			new_value := strings.TrimSpace(r.PostForm.Get(def.Key))
+			if new_value != "" && new_value != row.Value {
+				row.Value = new_value
+				parsed, err := parseSetting(def, new_value, template_data.Fahrenheit)
+				if err != nil {
+					row.Error = err.Error()
+					failed = true
+				} else if parsed != value {
+					changes[def.Key] = parsed
+					stored[def.Key] = parsed
+				}
+			}
+		}
+		template_data.Settings = append(template_data.Settings, row)
+	}
+
+	if r.Method == "POST" && !failed && len(changes) > 0 {
+		if err := t.decider.settings.SetMany(changes, webActor(r)); err != nil {
+			template_data.Error = err.Error()
+			failed = true
+		}
+	}
+
+	if r.Method == "POST" && !failed {
+		location := "/settings?saved=1"
+		if template_data.Fahrenheit {
+			location += "&unit=f"
+		}
+		http.Redirect(w, r, location, http.StatusSeeOther)
+		return
+	}
+	template_data.Saved = r.Form.Get("saved") == "1"
+	template_data.PrimaryUnset = stored[SETTING_PRIMARY_NODE] == ""
+
+	history, err := t.decider.settings.History(20)
+	if err != nil {
+		log.Println(err)
+	}
+	template_data.History = history
+
+	template, err := t.parseTemplate(r, t.config.Templates.Settings)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+
+	err = template.Execute(w, template_data)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Template error", 500)
+		return
+	}
+}
@@ -7,8 +7,8 @@ import (
 	"log"
 	"net/http"
 	"net/smtp"
+	"path/filepath"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -16,9 +16,11 @@ type WebServer struct {
 	decider        *Decider
 	config         *Config
 	dhcp_tailer    *DhcpStatus
+	auth           *AuthStore
 	server_started time.Time
-	servlets       map[string]func(http.ResponseWriter, *http.Request)
+	handler        http.Handler
 	last_update    time.Time
+	base_station   *BaseStation
 }
 
 func NewWebServer(c *Config, dhcp *DhcpStatus, decider *Decider) *WebServer {
@@ -26,12 +28,13 @@ func NewWebServer(c *Config, dhcp *DhcpStatus, decider *Decider) *WebServer {
 	t.decider = decider
 	t.dhcp_tailer = dhcp
 	t.config = c
+	t.auth = NewAuthStore(c)
 	t.server_started = time.Now().Round(time.Second)
-	t.servlets = make(map[string]func(http.ResponseWriter, *http.Request))
-	t.servlets["/control"] = t.ControlPage
-	t.servlets["/graph"] = http.FileServer(http.Dir("/var/www/nest")).ServeHTTP
+	t.base_station = NewBaseStation()
+	t.handler = chain(t.routes(), withRequestId, withAccessLog, withTiming, withRecovery)
 	t.last_update = time.Now()
 	go t.disconnectWatchdog()
+	go t.presencePlotter()
 	return t
 }
 
@@ -88,17 +91,73 @@ within the past 5 minutes.`)
 	}
 }
 
+// Load a page template, with helpers for rendering times in the display
+// timezone, and for the logged in user and their CSRF token.
+func (t *WebServer) parseTemplate(r *http.Request, path string) (*template.Template, error) {
+	auth := requestAuth(r)
+	return template.New(filepath.Base(path)).Funcs(template.FuncMap{
+		"localtime": t.config.FormatTime,
+		"user":      func() *User { return requestUser(r) },
+		"csrf": func() string {
+			if auth == nil || auth.Session == nil {
+				return ""
+			}
+			return auth.Session.Csrf
+		},
+	}).ParseFiles(path)
+}
+
+// Every page and where it lives
+func (t *WebServer) routes() *Router {
+	router := NewRouter()
+
+	// The base station and phones can't log in, so aren't protected
+	router.Handle("/control", t.ControlPage, "GET", "POST")
+	router.Handle(CONTROL_V2_PATH, t.ControlV2Page, "POST")
+	router.HandlePrefix("/presence/", t.PresenceApi)
+
+	router.Handle("/login", t.LoginPage, "GET", "POST")
+	router.Handle("/logout", t.protect(t.LogoutPage, PERMISSION_READ), "POST")
+	router.Handle("/account", t.protect(t.AccountPage, PERMISSION_READ), "GET", "POST")
+
+	router.Handle("/", t.protect(t.StatusPage, PERMISSION_CONTROL), "GET", "POST")
+	router.Handle("/settings", t.protect(t.SettingsPage, PERMISSION_CONTROL), "GET", "POST")
+	router.Handle("/guests", t.protect(t.GuestsPage, PERMISSION_CONTROL), "GET", "POST")
+	router.Handle("/people", t.protect(t.PeoplePage, PERMISSION_CONTROL), "GET", "POST")
+	router.Handle("/analytics", t.protect(t.AnalyticsPage, PERMISSION_CONTROL), "GET")
+	router.HandlePrefix(API_PREFIX, t.protect(t.ApiV1, PERMISSION_CONTROL))
+	router.Handle("/events", t.protect(t.EventsPage, PERMISSION_CONTROL), "GET")
+	router.Handle(METRICS_PATH, t.protect(t.MetricsPage, PERMISSION_CONTROL), "GET")
+	router.HandlePrefix("/graph", t.protect(http.FileServer(http.Dir("/var/www/nest")).ServeHTTP, PERMISSION_CONTROL), "GET")
+
+	return router
+}
+
 func (t *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	for path, servlet := range t.servlets {
-		if strings.HasPrefix(r.RequestURI, path) {
-			servlet(w, r)
-			return
-		}
+	t.handler.ServeHTTP(w, r)
+}
+
+// Actor recorded in the settings history for changes made by the base station
+const CONTROL_ACTOR = "control"
+
+// Actor recorded in the settings history for changes made through the web UI
+// or API
+func webActor(r *http.Request) string {
+	if user := requestUser(r); user != nil {
+		return "web " + user.Username + " " + r.RemoteAddr
 	}
-	t.StatusPage(w, r)
+	return "web " + r.RemoteAddr
+}
+
+// How somebody is shown on the status page
+type PersonStatus struct {
+	*Housemate
+	SeenDuration time.Duration
+	IsHome       string
 }
 
 type StatusInfo struct {
+	Now                time.Time
 	FurnaceState       string
 	CurrentTempC       string
 	CurrentTempF       string
@@ -107,21 +166,27 @@ type StatusInfo struct {
 	MinIdleTempC       string
 	MinIdleTempF       string
 	OverrideState      string
+	OverrideUntil      int64
 	HouseOccupied      string
-	People             []*Housemate
+	People             []*PersonStatus
 	History            []*ReadingData
 	ReadingHistoryText string
-	Farenheit          bool
+	Fahrenheit         bool
 	PeopleHistory      []*PeopleHistData
 	ShowGraph          bool
 	Override           bool
 	Uptime             time.Duration
 	RecentReadings     []*ReadingData
+	Ingest             *IngestStats
+	Degraded           bool
+	Database           *SettingsHealth
+	PrimaryUnset       bool
 }
 
 func (t *WebServer) GetStatusInfo(r *http.Request) *StatusInfo {
 	template_data := new(StatusInfo)
 
+	template_data.Now = time.Now()
 	template_data.Uptime = time.Now().Round(time.Second).Sub(t.server_started)
 
 	// Furnace State
@@ -157,33 +222,37 @@ func (t *WebServer) GetStatusInfo(r *http.Request) *StatusInfo {
 		template_data.HouseOccupied = "No"
 	}
 
-	template_data.People = t.dhcp_tailer.housemates
-	for _, person := range template_data.People {
-		person.SeenDuration = time.Now().Round(time.Second).Sub(person.Last_seen)
-		if person.SeenDuration < time.Minute*10 {
-			person.IsHome = "Yes"
+	now := time.Now()
+	for _, person := range t.dhcp_tailer.Snapshot().People {
+		status := &PersonStatus{Housemate: person}
+		status.SeenDuration = now.Round(time.Second).Sub(person.Last_seen)
+		if person.isHome() {
+			status.IsHome = "Yes"
+		} else if person.isNear(now) {
+			status.IsHome = "Nearly"
 		} else {
-			person.IsHome = "No"
+			status.IsHome = "No"
 		}
+		template_data.People = append(template_data.People, status)
 	}
 
 	if r.Form.Get("graph") == "on" {
 		template_data.ShowGraph = true
-		template_data.History = t.decider.getReadingHistoryForNode(255)
+		template_data.History = t.decider.getReadingHistoryForNode(255, HISTORY_PERIOD)
 		template_data.PeopleHistory = t.decider.getPeopleHistory()
 		if r.Form.Get("unit") == "f" {
-			template_data.Farenheit = true
+			template_data.Fahrenheit = true
 			for _, v := range template_data.History {
 				if v.Temp.Valid {
 					v.Temp.Float64 = v.Temp.Float64*1.8 + 32.0
 				}
 			}
 		} else {
-			template_data.Farenheit = false
+			template_data.Fahrenheit = false
 		}
 		err := generateTempPlot(
 			t.decider,
-			template_data.Farenheit,
+			template_data.Fahrenheit,
 			"/var/www/nest/graph_temp.png",
 		)
 		if err != nil {
@@ -207,25 +276,47 @@ func (t *WebServer) GetStatusInfo(r *http.Request) *StatusInfo {
 		template_data.ShowGraph = false
 	}
 
-	template_data.Override = t.decider.getOverride()
+	override := t.decider.getApiOverride()
+	template_data.Override = override.Active
+	if override.Until != nil {
+		template_data.OverrideUntil = override.Until.Unix()
+	}
+
+	_, err := t.decider.settings.GetInt(SETTING_PRIMARY_NODE)
+	template_data.PrimaryUnset = err == ErrSettingUnset
 
 	template_data.RecentReadings = t.decider.getRecentReadings()
 
+	template_data.Ingest = t.decider.ingest.Stats()
+
+	// Degraded if we're running on cached settings, or readings are backing up
+	template_data.Database = t.decider.settings.Health()
+	template_data.Degraded = template_data.Database.Degraded ||
+		template_data.Ingest.LastError != ""
+
 	return template_data
 }
 
 func (t *WebServer) StatusPage(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
-	if r.Form.Get("override") == "on" {
-		t.decider.setIntSetting(SETTING_OVERRIDE, time.Now().Unix())
-		http.Redirect(w, r, "/", 301)
-	} else if r.Form.Get(SETTING_OVERRIDE) == "off" {
-		t.decider.setIntSetting("override", 0)
-		http.Redirect(w, r, "/", 301)
+	// Only POSTs can change anything, so links can't turn the heat on
+	if r.Method == "POST" {
+		var err error
+		switch r.PostForm.Get("override") {
+		case "on":
+			err = t.decider.settings.SetInt(SETTING_OVERRIDE, time.Now().Unix(), webActor(r))
+		case "off":
+			err = t.decider.settings.SetInt(SETTING_OVERRIDE, 0, webActor(r))
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
 	}
 
-	template, err := template.ParseFiles(t.config.Templates.Status)
+	template, err := t.parseTemplate(r, t.config.Templates.Status)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Template error", 500)
@@ -243,6 +334,12 @@ func (t *WebServer) StatusPage(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Answer the base station, counting each kind of answer
+func (t *WebServer) controlResponse(w http.ResponseWriter, token string) {
+	metrics.CountControlResponse(token)
+	fmt.Fprint(w, token)
+}
+
 func (t *WebServer) ControlPage(w http.ResponseWriter, r *http.Request) {
 	t.last_update = time.Now()
 	r.ParseForm()
@@ -259,7 +356,7 @@ func (t *WebServer) ControlPage(w http.ResponseWriter, r *http.Request) {
 	node_id, err := strconv.ParseInt(node_id_s, 10, 64)
 	if err != nil {
 		log.Println(err)
-		fmt.Fprintf(w, "burn-n")
+		t.controlResponse(w, "burn-n")
 		return
 	}
 
@@ -285,15 +382,15 @@ func (t *WebServer) ControlPage(w http.ResponseWriter, r *http.Request) {
 	// If none of the readings made sense, there's no point saving any of them.
 	if !current_temp.Valid && !current_pressure.Valid && !current_humidity.Valid {
 		log.Println("Got useless info from node", node_id)
-		fmt.Fprintf(w, "burn-n")
+		t.controlResponse(w, "burn-n")
 		return
 	}
 
 	// Grab the primary node (the node we use to control the heater)
-	primary_node, err := t.decider.getIntSetting(SETTING_PRIMARY_NODE)
+	primary_node, err := t.decider.settings.GetInt(SETTING_PRIMARY_NODE)
 	if err != nil {
 		log.Println(err)
-		fmt.Fprintf(w, "burn-i")
+		t.controlResponse(w, "burn-i")
 		return
 	}
 
@@ -301,19 +398,23 @@ func (t *WebServer) ControlPage(w http.ResponseWriter, r *http.Request) {
 	t.decider.LogReading(node_id, current_temp, current_pressure, current_humidity)
 
 	// If this reading was from the primary, update the heater. Otherwise,
-	// no change.
+	// no change, unless somebody came or went since the last poll.
 	if node_id == primary_node && current_temp.Valid {
 		furnace_on := t.decider.ShouldFurnace(current_temp.Float64)
-		err = t.decider.setBoolSetting(SETTING_FURNACE_ON, furnace_on)
-		if err != nil {
-			log.Println(err)
+		t.decider.commandFurnace(furnace_on, CONTROL_ACTOR)
+		if furnace_on {
+			t.controlResponse(w, "burn-y")
+		} else {
+			t.controlResponse(w, "burn-n")
 		}
+	} else if furnace_on, ok := t.decider.takePendingFurnace(); ok {
+		t.decider.commandFurnace(furnace_on, PRESENCE_ACTOR)
 		if furnace_on {
-			fmt.Fprintf(w, "burn-y")
+			t.controlResponse(w, "burn-y")
 		} else {
-			fmt.Fprintf(w, "burn-n")
+			t.controlResponse(w, "burn-n")
 		}
 	} else {
-		fmt.Fprintf(w, "burn-i")
+		t.controlResponse(w, "burn-i")
 	}
 }